@@ -2,7 +2,7 @@
 // A sequential web crawler in Go that:
 // 1. Accepts a target domain (and optional HTTP scheme) as command-line arguments
 // 2. Recursively crawls all pages under the same domain
-// 3. Extracts every JavaScript file and modulepreload/prefetch URLs ending with .js
+// 3. Extracts every JavaScript file and modulepreload/prefetch URLs with a JS extension (.js, .mjs by default)
 // 4. Writes discovered JS URLs to "<domain>_all_js.txt"
 // 5. Tests each JS URL for HTTP status:
 //    - Status < 400: written to "<domain>_good_js.txt"
@@ -12,208 +12,4580 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"html/template"
 	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/idna"
 )
 
+// Crawler crawls a single domain and tests the JS files it finds
+type Crawler struct {
+	Domain           string        // host to crawl, e.g. example.com
+	Scheme           string        // http or https
+	AcceptLanguage   string        // Accept-Language sent on page requests; empty sends none
+	NoAll            bool          // don't create the all-JS file
+	NoGood           bool          // don't create the good-JS file
+	NoBad            bool          // don't create the bad-JS file
+	GroupByHost      bool          // group the all-JS file by host
+	PhaseDelay       time.Duration // pause between crawling and testing
+	JSExts           []string      // URL path extensions treated as JS; defaults to .js and .mjs
+	MaxRequests      int           // cap on HTTP requests across crawl and test; 0 is unlimited
+	CrawlTimeout     time.Duration // time limit for the crawl phase; 0 is unlimited
+	TestTimeout      time.Duration // time limit for the JS-testing phase; 0 is unlimited
+	TLSInfo          bool          // record negotiated TLS version and cipher per host
+	WithReferrer     bool          // append the first referring page to each output line
+	SendReferer      bool          // send the first referring page as the Referer of each JS test request
+	NoCrawl          bool          // fetch only the root page; never follow links
+	SaveErrors       bool          // save bodies of non-2xx pages under <domain>_error_pages/
+	Baseline         string        // prior hash manifest; changed or new good JS is reported
+	Format           string        // extra results report: "text" (none), "html" or "json"
+	OnlyStatus       []int         // when set, only results with these statuses are logged and written; 0 means fetch errors
+	Append           bool          // append to existing output files instead of truncating
+	Client           *http.Client
+	Sink             ResultSink     // where results go; defaults to the <domain>_*_js.txt files. Run doesn't close a caller's Sink.
+	Extractors       []Extractor    // JS discovery rules run on every page; defaults to DefaultExtractors()
+	Links            LinkRules      // which tags count as crawlable links
+	RespectCanonical bool           // mark a page's <link rel=canonical> as seen and attribute its JS there
+	PathPrefixes     []string       // when set, only crawl paths starting with one of these; seeds start there too
+	VerifySRI        bool           // check good JS against its <script integrity> hash
+	ValidateJS       bool           // download good JS and move bodies that aren't JavaScript to a suspect list
+	RetrySlash       bool           // retry a page that 404s once with a trailing slash
+	ReportSlow       int            // log the N slowest JS responses after testing; 0 disables
+	Since            time.Time      // when set, pages are requested with If-Modified-Since and 304s skipped
+	StrictJS         bool           // only 2xx JS counts as good; JS redirects aren't followed and count as bad
+	ErrorLog         bool           // also write [ERROR] lines to <domain>_errors.log
+	Order            string         // crawl order: "bfs" (default) or "dfs"
+	StripParams      []string       // query parameters removed from page and JS URLs, e.g. utm_source
+	NotifyURL        string         // POST a JSON summary here when the run finishes
+	ScanCSS          bool           // fetch linked stylesheets and collect JS they reference
+	SameOrigin       bool           // scope is the root's scheme, host and port rather than just host[:port]
+	StreamParse      bool           // tokenize pages into a flat list of tags instead of building a DOM
+	SummaryJSON      bool           // write run totals to <domain>_summary.json
+	RespectRobots    bool           // honor <meta name=robots>: nofollow stops link-following, noindex is noted
+	MaxJSSize        int64          // skip reading JS bodies larger than this many bytes; 0 is unlimited
+	ExternalJS       bool           // also split discovered JS into on-domain (internal) and off-domain (external) files
+	LogProto         bool           // log the negotiated HTTP protocol the first time each host responds
+	CollapseHash     *regexp.Regexp // when set, report JS grouped by URL with this content-hash segment stripped
+	ConfigJS         *regexp.Regexp // when set, JS whose file name matches is listed as likely client config
+	CrawlForms       bool           // submit in-scope POST forms with their default values and crawl the result; off under StreamParse
+	FormSkip         *regexp.Regexp // forms whose action, name or buttons match aren't submitted; defaultFormSkip if nil
+	RoutesFromJS     bool           // download newly found JS during the crawl and queue route-like paths it contains
+	TUI              bool           // show a live progress view instead of the line log when stdout is a terminal
+	TestHosts        []string       // when set, only JS on these hostnames (or the crawl host) is tested
+	DepthPerHost     int            // max link hops from where the crawl entered each host; 0 is unlimited
+	Scope            []string       // host globs like *.example.com that are crawled instead of just the domain
+	SeedBothWWW      bool           // also seed and crawl the www/non-www variant of the domain
+	SplitByStatus    bool           // also write tested JS to one file per status, e.g. <domain>_js_404.txt
+	Bloom            bool           // back the seen-URL set with a bloom filter to bound memory; see bloomSet
+	BloomCapacity    int            // URLs the bloom filter is sized for
+	BloomFPRate      float64        // target false-positive rate at BloomCapacity
+	PrefetchDNS      bool           // resolve every JS host in parallel before testing
+	KnownJS          string         // approved JS list; anything else found goes to <domain>_new_js.txt
+	FailOnNew        bool           // make Run return an error when KnownJS is set and new JS was found
+	SnapshotInterval time.Duration  // save crawl progress to <domain>_snapshot.json this often, resuming from it on the next run
+	CountOnly        bool           // only crawl and print page and JS counts; nothing is tested or written to disk
+	ScanJSONBlocks   bool           // mine <script type="application/json"> blocks for JS URLs and page paths
+	ConnStats        bool           // count new vs reused connections and DNS lookups for the summary
+	AtomicOutput     bool           // write output files as <name>.tmp and rename them into place when complete
+	Concurrency      int            // JS files tested at once; 0 or 1 tests them one by one
+	PerHostConc      int            // cap on in-flight requests to any one host, crawl and test alike; 0 is unlimited
+	IgnoreBase       bool           // resolve page URLs against the page itself even if it has a <base href>
+	GraphOutput      string         // write the in-scope link graph as JSON {page: [linked pages]} to this file
+	PagesOutput      string         // write every successfully fetched page URL to this file
+	AutoUA           bool           // if the root looks blocked (403/503), retry it with a browser User-Agent and keep that UA
+	Headless         bool           // parse the DOM as rendered by headless Chrome instead of the raw HTML
+	HeadlessBin      string         // Chrome/Chromium executable for Headless; found on PATH when empty
+	HeadlessWait     time.Duration  // virtual time scripts get to run before the DOM is captured
+	RetestAll        bool           // under Append, test JS again even if the prior good/bad files already classify it
+	CompressOutput   bool           // write the .txt outputs gzipped, as .txt.gz
+	Explain          bool           // log why each candidate link wasn't queued, at the EXPLAIN level
+	MaxErrors        int            // stop crawling and testing after this many fetch failures in a row; 0 never stops
+	AdaptiveDelay    bool           // wait before each request, backing off on 403/429/503 and speeding up on success
+	MinDelay         time.Duration  // lower bound of the adaptive delay
+	MaxDelay         time.Duration  // upper bound of the adaptive delay
+
+	// OnJSFound is called synchronously the first time each JS URL is discovered
+	OnJSFound func(url string)
+	// OnJSTested is called synchronously after each JS URL is tested; status is 0 when err is set
+	OnJSTested func(url string, status int, err error)
+
+	client    *http.Client
+	jsClient  *http.Client      // client for JS tests; doesn't follow redirects under StrictJS
+	host      string            // effective host for scope checks; differs from Domain after a www redirect
+	scheme    string            // effective root scheme for -same-origin; follows a root redirect
+	seen      urlSet            // pages queued or fetched
+	jsSet     map[string]string // JS URL -> first page that referenced it
+	prior     map[string]bool   // JS already in the all-file when appending
+	tested0   map[string]bool   // JS in the prior good/bad files when appending, skipped by testJS and absent from the summary and reports
+	tested    int
+	unchanged int                 // pages skipped with 304 Not Modified under -since
+	fetched   int                 // pages answered with 2xx, or 304 under -since
+	rootStat  int                 // final status of the root page, 0 if it couldn't be fetched
+	userAgent string              // User-Agent sent on every request once -auto-ua switched to it
+	browser   string              // resolved HeadlessBin, or "" to fetch statically
+	errStreak int                 // consecutive fetch failures, for MaxErrors
+	trip      context.CancelFunc  // stops the run once errStreak reaches MaxErrors
+	throttle  *throttle           // adaptive per-request delay under AdaptiveDelay
+	cssSeen   map[string]bool     // stylesheets already scanned under -scan-css
+	formsSeen map[string]bool     // form actions already submitted under -crawl-forms
+	noindex   int                 // pages marked noindex under -respect-meta-robots
+	routes    int                 // pages queued from JS routes under -routes-from-js
+	depth     map[string]int      // queued page -> hops since the crawl entered its host
+	stateMu   sync.RWMutex        // held by crawl except between pages, so snapshots see consistent state
+	conns     connCounts          // connection reuse seen by -conn-stats
+	hostSlots *hostLimiter        // per-host request slots under PerHostConc
+	protoMu   sync.Mutex          // guards protos, which concurrent JS tests update
+	graph     map[string][]string // page -> in-scope pages it links to, under GraphOutput
+	pages     map[string]bool     // pages fetched OK, under PagesOutput
+	requests  atomic.Int64
+	budgetHit atomic.Bool
+	tlsInfo   map[string]string // host -> negotiated TLS summary
+	protos    map[string]string // host -> negotiated HTTP protocol, under LogProto
+	baseline  map[string]string // JS URL -> SHA-256 from the -baseline manifest
+	hashes    map[string]string // JS URL -> SHA-256 of good JS downloaded this run
+	integrity map[string]string // JS URL -> integrity attribute from its <script> tag
+	sriBad    []string          // "url\texpected" lines for JS failing its integrity check
+	suspect   []string          // "url\treason" lines for good JS whose body isn't JavaScript, under ValidateJS
+	known     map[string]bool   // normalized KnownJS entries
+	newJS     int               // JS found that isn't in known
+	results   []jsResult
+	durations map[string]time.Duration // JS URL -> response time when tested
+	sink      ResultSink
+	errs      atomic.Int64 // [ERROR] lines logged by this run
+	errorLog  *lineWriter  // copy of this run's [ERROR] lines under ErrorLog
+	certs     certReport   // invalid certificates met during this run
+	summaryMu sync.Mutex
+	summary   Summary // totals of the last Run
+}
+
+// Summary is the totals of a run, as reported in the CLI's closing log lines
+type Summary struct {
+	PagesVisited int
+	JSFound      int
+	Good         int
+	Bad          int
+	Suspect      int           // good status but not JavaScript, under -validate-js; in neither Good nor Bad
+	Errors       int64         // [ERROR] lines logged
+	Duration     time.Duration // wall time of the whole run
+	StatusCounts map[int]int   // tested JS by status; 0 counts failed fetches
+}
+
 func main() {
 	// Parse arguments
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run jsCrawler.go <domain> [http|https]")
+	c := &Crawler{}
+	flag.StringVar(&c.AcceptLanguage, "accept-language", "", "Accept-Language header sent on page requests (default: none, server default)")
+	flag.BoolVar(&c.NoAll, "no-all", false, "Don't create the all-JS file")
+	flag.BoolVar(&c.NoGood, "no-good", false, "Don't create the good-JS file")
+	flag.BoolVar(&c.NoBad, "no-bad", false, "Don't create the bad-JS file")
+	flag.BoolVar(&c.GroupByHost, "group-by-host", false, "Group the all-JS file by host, with a '# host' header before each group")
+	flag.DurationVar(&c.PhaseDelay, "phase-delay", 0, "Pause between finishing the crawl and testing JS (e.g. 30s)")
+	flag.IntVar(&c.MaxRequests, "max-requests", 0, "Stop fetching after N HTTP requests in total, crawl and test combined (0 = unlimited)")
+	flag.DurationVar(&c.CrawlTimeout, "crawl-timeout", 0, "Stop crawling after this long and move on with what was found (0 = unlimited)")
+	flag.DurationVar(&c.TestTimeout, "test-timeout", 0, "Stop testing JS after this long and write what was tested (0 = unlimited)")
+	flag.BoolVar(&c.TLSInfo, "tls-info", false, "Write the negotiated TLS version and cipher for the root and JS hosts to <domain>_tls.txt")
+	flag.BoolVar(&c.Append, "append", false, "Append to existing output files; JS already in the all-JS file isn't written again")
+	flag.StringVar(&c.Format, "format", "text", "Results format: text (the .txt files only), html (also writes <domain>_report.html) or json (also writes <domain>_results.json)")
+	onlyStatus := flag.String("only-status", "", "Comma-separated statuses (e.g. 403,404) to keep in the results; 0 keeps fetch errors")
+	flag.StringVar(&c.Baseline, "baseline", "", "Hash manifest from a prior run; good JS whose content changed or is new goes to <domain>_changed_js.txt")
+	flag.BoolVar(&c.SaveErrors, "save-errors", false, "Save the body of each non-2xx page to <domain>_error_pages/")
+	flag.BoolVar(&c.Links.SkipNofollow, "skip-nofollow", false, "Don't follow <a rel=\"nofollow\"> links (followed by default)")
+	flag.BoolVar(&c.Links.FollowCanonical, "follow-canonical", false, "Also follow <link rel=\"canonical\" href> as a crawlable page")
+	flag.BoolVar(&c.Links.FollowAlternate, "follow-alternates", false, "Also follow <link rel=\"alternate\" hreflang href> locale variants (still subject to scope)")
+	pathPrefix := flag.String("path-prefix", "", "Comma-separated path prefixes (e.g. /docs) to confine the crawl to; seeding starts there")
+	flag.BoolVar(&c.RespectCanonical, "respect-canonical", false, "Treat a page's rel=canonical URL as already crawled and attribute the page's JS to it")
+	flag.BoolVar(&c.VerifySRI, "verify-sri", false, "Check good JS against <script integrity> hashes; mismatches go to <domain>_sri_mismatch.txt")
+	flag.BoolVar(&c.ValidateJS, "validate-js", false, "Download good JS and check it's JavaScript; HTML soft-404s and the like go to <domain>_suspect_js.txt instead of the good file")
+	flag.BoolVar(&c.RetrySlash, "retry-slash", false, "Retry a page that returns 404 once with a trailing slash (for static hosts that need /path/)")
+	flag.IntVar(&c.ReportSlow, "report-slow", 0, "After testing, list the N slowest JS files by response time")
+	since := flag.String("since", "", "Send If-Modified-Since with this RFC3339 time on page requests and skip pages answering 304")
+	flag.BoolVar(&c.StrictJS, "strict-js", false, "Count only 2xx JS as good; redirects go to the bad file, with their status, instead of being followed")
+	flag.BoolVar(&c.ErrorLog, "error-log", false, "Also collect [ERROR] lines (fetch, read and parse failures) in <domain>_errors.log")
+	flag.StringVar(&c.Order, "order", "bfs", "Crawl order: bfs (breadth-first) or dfs (depth-first); each page's links are queued sorted")
+	stripParams := flag.String("strip-params", "", "Comma-separated query parameters (e.g. utm_source,fbclid,gclid) removed from page and JS URLs")
+	flag.StringVar(&c.NotifyURL, "notify-url", "", "POST a JSON summary (pages, JS found, bad count) to this URL when each run finishes")
+	flag.BoolVar(&c.ScanCSS, "scan-css", false, "Fetch linked stylesheets and collect JS referenced by url(), @import or worker registrations")
+	flag.BoolVar(&c.SameOrigin, "same-origin", false, "Only crawl pages with the root's scheme, host and port (default scope is the host alone)")
+	flag.BoolVar(&c.StreamParse, "stream-parse", false, "Tokenize pages instead of building a full DOM, to lower memory on large pages")
+	flag.BoolVar(&c.SummaryJSON, "summary-json", false, "Write run totals (pages, JS found, good, bad, errors, duration) to <domain>_summary.json")
+	flag.BoolVar(&c.RespectRobots, "respect-meta-robots", false, "Honor <meta name=\"robots\">: don't follow links on nofollow pages and note noindex pages")
+	flag.Int64Var(&c.MaxJSSize, "max-js-size", 0, "Don't download JS bodies (for -baseline, -verify-sri and -validate-js) over this many bytes; status is still recorded (0 = unlimited)")
+	flag.BoolVar(&c.ExternalJS, "external-js", false, "Also write discovered JS split into <domain>_internal_js.txt and <domain>_external_js.txt")
+	collapseHash := flag.Bool("collapse-hash", false, "Also report JS grouped by logical name, with build hashes (see -hash-pattern) stripped, in <domain>_collapsed_js.txt")
+	hashPattern := flag.String("hash-pattern", `\.[0-9a-f]{8,}(\.m?js)$`, "Regexp for the hash segment -collapse-hash strips; the match is replaced by its first group, if any")
+	configJS := flag.Bool("config-js", false, "List JS whose file name looks like client config (see -config-pattern) in <domain>_config_js.txt")
+	flag.BoolVar(&c.CrawlForms, "crawl-forms", false, "Submit in-scope POST forms with their default and hidden values and crawl the page they return (skips forms matching -form-skip)")
+	formSkip := flag.String("form-skip", defaultFormSkip.String(), "Regexp matched against a form's action, id, name and button labels; -crawl-forms never submits matching forms")
+	configPattern := flag.String("config-pattern", `(?i)^(config|env|settings|runtime)([._-][^/]*)?\.m?js$`, "Regexp matched against JS file names by -config-js")
+	flag.BoolVar(&c.RoutesFromJS, "routes-from-js", false, "Download JS as it's found and crawl route-like string literals in it (e.g. \"/dashboard\"), for client-rendered sites")
+	flag.BoolVar(&c.TUI, "tui", false, "Show a live progress view (recent pages, queue, JS and error counts) while crawling and testing; needs a terminal")
+	testHosts := flag.String("test-hosts", "", "Comma-separated hostnames whose JS is tested besides the domain's own; other JS is only listed (default: test all)")
+	flag.IntVar(&c.DepthPerHost, "depth-per-host", 0, "Follow links at most N hops from where the crawl entered each host (0 = unlimited)")
+	scope := flag.String("scope", "", "Comma-separated host globs to crawl instead of just the domain (e.g. *.example.com,app-*.example.net)")
+	flag.BoolVar(&c.SeedBothWWW, "seed-both-www", false, "Seed and crawl both example.com and www.example.com in one run")
+	flag.BoolVar(&c.SplitByStatus, "split-by-status", false, "Also write tested JS to a file per status (<domain>_js_200.txt, <domain>_js_404.txt, ...; fetch errors in <domain>_js_error.txt)")
+	flag.BoolVar(&c.Bloom, "bloom", false, "Track seen pages in a bloom filter to bound memory on huge crawls; a few pages may be skipped as false positives, none fetched twice")
+	flag.IntVar(&c.BloomCapacity, "bloom-capacity", 1000000, "Number of pages the -bloom filter is sized for")
+	flag.Float64Var(&c.BloomFPRate, "bloom-fp", 0.001, "Target false-positive rate for -bloom (fraction of new pages wrongly skipped)")
+	flag.BoolVar(&c.PrefetchDNS, "prefetch-dns", false, "Resolve all JS hosts in parallel before testing to warm the resolver cache on multi-CDN sites")
+	flag.StringVar(&c.KnownJS, "known-js", "", "File of approved JS URLs; discovered JS not listed is written to <domain>_new_js.txt")
+	flag.BoolVar(&c.FailOnNew, "fail-on-new", false, "Exit non-zero when -known-js is set and new JS was found")
+	flag.DurationVar(&c.SnapshotInterval, "snapshot-interval", 0, "Save crawl progress (seen pages, queue, JS) this often; a later run with the flag resumes from the last snapshot (0 = off)")
+	flag.BoolVar(&c.CountOnly, "count-only", false, "Just crawl and print how many pages and JS files were found; no testing, no files written")
+	flag.BoolVar(&c.ScanJSONBlocks, "scan-json-blocks", false, "Mine JSON script blocks (e.g. Next.js __NEXT_DATA__) for JS URLs and same-site paths to crawl")
+	flag.BoolVar(&c.ConnStats, "conn-stats", false, "Count new vs reused connections and DNS lookups and report them in the summary")
+	flag.BoolVar(&c.AtomicOutput, "atomic-output", false, "Write each output file to <name>.tmp and rename it into place once complete, so watchers never see a partial file")
+	flag.IntVar(&c.Concurrency, "concurrency", 1, "Number of JS files to test at once")
+	flag.IntVar(&c.PerHostConc, "per-host-concurrency", 0, "Cap on concurrent requests to any single host, below -concurrency (0 = unlimited)")
+	flag.BoolVar(&c.IgnoreBase, "ignore-base", false, "Resolve script and link URLs against the page URL, ignoring any <base href> (for sites with broken base tags)")
+	flag.StringVar(&c.GraphOutput, "graph-output", "", "Write the crawl's link graph as JSON {page: [linked pages]} to this file, in-scope links only")
+	flag.StringVar(&c.PagesOutput, "pages-output", "", "Write every successfully fetched page URL to this file, sorted, one per line")
+	flag.BoolVar(&c.AutoUA, "auto-ua", false, "If the root answers 403/503, retry it with a browser User-Agent and use that for the rest of the run")
+	flag.BoolVar(&c.Headless, "headless", false, "Render each page in headless Chrome/Chromium, parsing the resulting DOM and collecting the JS it loads (runtime script tags, import() and XHR chunks); each page is fetched again by the browser. Falls back to static HTML if no browser is found")
+	flag.StringVar(&c.HeadlessBin, "headless-bin", "", "Chrome/Chromium executable for -headless (default: search PATH)")
+	flag.DurationVar(&c.HeadlessWait, "headless-wait", 5*time.Second, "How long pages may run scripts under -headless before the DOM is captured")
+	flag.BoolVar(&c.RetestAll, "retest-all", false, "With -append, test every JS again instead of skipping URLs already in the good/bad files; skipped JS isn't counted in the summary, -json or -html. Implied by -baseline, -verify-sri and -validate-js")
+	flag.BoolVar(&c.CompressOutput, "compress-output", false, "Write the .txt outputs gzip-compressed, as .txt.gz")
+	flag.BoolVar(&c.Explain, "explain", false, "Log why each link found wasn't crawled (off-domain, already seen, nofollow, over depth, ...) as [EXPLAIN] lines")
+	flag.IntVar(&c.MaxErrors, "max-errors", 0, "Stop after N consecutive failed fetches (network errors, 403, 429, 5xx) and write what was gathered (0 = never)")
+	flag.BoolVar(&c.AdaptiveDelay, "adaptive-delay", false, "Throttle automatically: double the delay between requests on 403/429/503, shrink it gradually on success")
+	flag.DurationVar(&c.MinDelay, "min-delay", 0, "Lowest delay between requests under -adaptive-delay")
+	flag.DurationVar(&c.MaxDelay, "max-delay", 30*time.Second, "Highest delay between requests under -adaptive-delay")
+	flag.BoolVar(&c.NoCrawl, "no-crawl", false, "Fetch only the root page and test its JS without following links")
+	flag.BoolVar(&c.WithReferrer, "with-referrer", false, "Append the first page that referenced each JS URL to its output line (tab-separated)")
+	flag.BoolVar(&c.SendReferer, "send-referer", false, "Send the page that first referenced each JS file as its Referer when testing it, for CDNs with hotlink protection")
+	jsExt := flag.String("js-ext", ".js,.mjs", "Comma-separated URL path extensions treated as JS")
+	logJSON := flag.Bool("log-json", false, "Log single-line JSON objects (level, msg, url, status) instead of text")
+	clientCert := flag.String("client-cert", "", "PEM client certificate for mutual TLS (requires -client-key)")
+	clientKey := flag.String("client-key", "", "PEM private key for -client-cert")
+	proxyFile := flag.String("proxy-file", "", "File of proxy URLs, one per line, rotated round-robin per request; unreachable ones are skipped for a while")
+	useHTTP2 := flag.Bool("http2", false, "Force HTTP/2: over TLS for https and h2c (prior knowledge) for http; logs the protocol per host")
+	headerTimeout := flag.Duration("header-timeout", 0, "Give up on a request if the response headers don't arrive within this long, failing fast on dead hosts (0 = no limit)")
+	timeout := flag.Duration("timeout", 0, "Overall limit per request, including reading the body; keep it above -header-timeout so large JS can still download (0 = no limit)")
+	insecure := flag.Bool("insecure", false, "Fetch from hosts with invalid TLS certificates anyway; they're still logged as [TLS] and listed in <domain>_tls_errors.txt")
+	deepExtract := flag.Bool("deep-extract", false, "Also scan inline scripts for document.write('<script src=...>') loaders, as used by legacy ad/analytics tags")
+	cookieFile := flag.String("cookie-file", "", "Load cookies from a Netscape-format cookies.txt (as exported by browsers or curl)")
+	var resolves stringList
+	flag.Var(&resolves, "resolve", "Pin a host to an IP as host:ip, like curl --resolve (repeatable)")
+	diffMode := flag.Bool("diff", false, "Compare two JS lists from prior runs (-diff old.txt new.txt), printing added (+) and removed (-) URLs; exits 1 if they differ")
+	configFile := flag.String("config", "", "JSON file of flag values keyed by flag name, e.g. {\"max-requests\": 500}; command-line flags override it")
+	flag.Usage = func() {
+		fmt.Println("Usage: go run jsCrawler.go [flags] <domain|-> [http|https]")
+		fmt.Println("       go run jsCrawler.go -diff <old.txt> <new.txt>")
+		fmt.Println("  Pass - (or pipe input with no domain) to read domains from stdin, one per line")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *configFile != "" {
+		if err := applyConfig(*configFile); err != nil {
+			logf(levelError, "Config %s: %v", *configFile, err)
+			os.Exit(1)
+		}
+	}
+	if *logJSON {
+		jsonLog = newJSONLogger()
+	}
+	if *diffMode {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(diffURLLists(flag.Arg(0), flag.Arg(1)))
+	}
+
+	var domains []string
+	if flag.NArg() >= 1 && flag.Arg(0) != "-" {
+		domains = []string{flag.Arg(0)}
+	} else if flag.NArg() >= 1 || !stdinIsTerminal() {
+		domains = readDomains(os.Stdin)
+	}
+	if len(domains) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	c.JSExts = splitList(*jsExt)
+	c.StripParams = splitList(*stripParams)
+	c.TestHosts = splitList(*testHosts)
+	for _, pattern := range splitList(*scope) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			logf(levelError, "Invalid -scope pattern %q: %v", pattern, err)
+			os.Exit(1)
+		}
+		c.Scope = append(c.Scope, strings.ToLower(pattern))
+	}
+	if *collapseHash {
+		re, err := regexp.Compile(*hashPattern)
+		if err != nil {
+			logf(levelError, "Invalid -hash-pattern: %v", err)
+			os.Exit(1)
+		}
+		c.CollapseHash = re
+	}
+	if c.CrawlForms {
+		re, err := regexp.Compile(*formSkip)
+		if err != nil {
+			logf(levelError, "Invalid -form-skip: %v", err)
+			os.Exit(1)
+		}
+		c.FormSkip = re
+	}
+	if *configJS {
+		re, err := regexp.Compile(*configPattern)
+		if err != nil {
+			logf(levelError, "Invalid -config-pattern: %v", err)
+			os.Exit(1)
+		}
+		c.ConfigJS = re
+	}
+	for _, prefix := range splitList(*pathPrefix) {
+		if !strings.HasPrefix(prefix, "/") {
+			prefix = "/" + prefix
+		}
+		c.PathPrefixes = append(c.PathPrefixes, prefix)
+	}
+	for _, v := range splitList(*onlyStatus) {
+		code, err := strconv.Atoi(v)
+		if err != nil {
+			logf(levelError, "Invalid -only-status %q", v)
+			os.Exit(1)
+		}
+		c.OnlyStatus = append(c.OnlyStatus, code)
+	}
+	if *since != "" {
+		t, err := time.Parse(time.RFC3339, *since)
+		if err != nil {
+			logf(levelError, "Invalid -since %q: %v", *since, err)
+			os.Exit(1)
+		}
+		c.Since = t
+	}
+	if c.AdaptiveDelay && (c.MinDelay < 0 || c.MaxDelay < c.MinDelay) {
+		logf(levelError, "-min-delay must be at least 0 and at most -max-delay")
+		os.Exit(1)
+	}
+	if c.CrawlForms && c.StreamParse {
+		logf(levelError, "-crawl-forms can't be combined with -stream-parse, which doesn't tie fields to their forms")
+		os.Exit(1)
+	}
+	if c.SnapshotInterval > 0 && c.Bloom {
+		logf(levelError, "-snapshot-interval can't be combined with -bloom, whose seen set can't be saved")
+		os.Exit(1)
+	}
+	if c.Order != "bfs" && c.Order != "dfs" {
+		logf(levelError, "Unknown -order %q, want bfs or dfs", c.Order)
+		os.Exit(1)
+	}
+	if c.Format != "text" && c.Format != "html" && c.Format != "json" {
+		logf(levelError, "Unknown -format %q, want text, html or json", c.Format)
+		os.Exit(1)
+	}
+	scheme := "https"
+	if flag.NArg() >= 2 {
+		scheme = strings.TrimRight(flag.Arg(1), ":/")
+	}
+
+	var cfg clientConfig
+	var err error
+	cfg.resolves, err = parseResolves(resolves)
+	if err != nil {
+		logf(levelError, "%v", err)
+		os.Exit(1)
+	}
+	if *clientCert != "" || *clientKey != "" {
+		if *clientCert == "" || *clientKey == "" {
+			logf(levelError, "-client-cert and -client-key must be given together")
+			os.Exit(1)
+		}
+		cert, err := tls.LoadX509KeyPair(*clientCert, *clientKey)
+		if err != nil {
+			logf(levelError, "Load client certificate: %v", err)
+			os.Exit(1)
+		}
+		cfg.certs = []tls.Certificate{cert}
+	}
+	if *proxyFile != "" {
+		cfg.proxies, err = loadProxies(*proxyFile)
+		if err != nil {
+			logf(levelError, "Load proxies: %v", err)
+			os.Exit(1)
+		}
+	}
+	if *useHTTP2 {
+		if cfg.proxies != nil {
+			logf(levelError, "-http2 can't be combined with -proxy-file")
+			os.Exit(1)
+		}
+		cfg.http2 = true
+		c.LogProto = true
+	}
+	if *cookieFile != "" {
+		cfg.jar, err = loadCookieFile(*cookieFile)
+		if err != nil {
+			logf(levelError, "Load cookies: %v", err)
+			os.Exit(1)
+		}
+	}
+	if *headerTimeout < 0 || *timeout < 0 {
+		logf(levelError, "-header-timeout and -timeout can't be negative")
+		os.Exit(1)
+	}
+	if *timeout > 0 && *headerTimeout > *timeout {
+		logf(levelDebug, "-header-timeout %s exceeds -timeout %s; -timeout applies first", *headerTimeout, *timeout)
+	}
+	cfg.headerTimeout, cfg.timeout = *headerTimeout, *timeout
+	cfg.insecure = *insecure
+	c.Client = newClient(cfg)
+	if *deepExtract {
+		c.Extractors = append(DefaultExtractors(), DocumentWriteExtractor{})
+	}
+	c.OnJSFound = func(js string) {
+		logURL(levelDebug, "Found JS", js, 0, nil)
+	}
+
+	ctx := interruptContext()
+	failed := false
+	for _, domain := range domains {
+		if ctx.Err() != nil {
+			break
+		}
+		// A domain given as a URL supplies its own scheme unless one was passed explicitly
+		host, urlScheme := splitDomainArg(domain)
+		if ascii := asciiHost(host); ascii != host {
+			logf(levelDebug, "Using %s for internationalized domain %s", ascii, host)
+			host = ascii
+		}
+		c.Domain, c.Scheme = host, scheme
+		if urlScheme != "" && flag.NArg() < 2 {
+			c.Scheme = urlScheme
+		}
+		if err := c.Run(ctx); err != nil {
+			logf(levelError, "%s: %v", domain, err)
+			failed = true
+		}
+	}
+	if failed {
 		os.Exit(1)
 	}
-	domain := os.Args[1]
-	scheme := "https"
-	if len(os.Args) >= 3 {
-		scheme = strings.TrimRight(os.Args[2], ":/")
+}
+
+// applyConfig sets flags from a JSON object keyed by flag name. Flags given on the
+// command line win; unknown keys are an error. Lists may be JSON arrays: repeatable
+// flags get one value per element, comma-separated ones the joined elements.
+func applyConfig(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		f := flag.Lookup(key)
+		if f == nil || key == "config" {
+			return fmt.Errorf("unknown option %q", key)
+		}
+		if explicit[key] {
+			continue
+		}
+		var v any
+		dec := json.NewDecoder(bytes.NewReader(values[key]))
+		dec.UseNumber() // keep 1000000 from printing as 1e+06
+		if err := dec.Decode(&v); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		items, ok := v.([]any)
+		if !ok {
+			items = []any{v}
+		}
+		strs := make([]string, len(items))
+		for i, item := range items {
+			strs[i] = fmt.Sprint(item)
+		}
+		if _, repeatable := f.Value.(*stringList); !repeatable {
+			strs = []string{strings.Join(strs, ",")}
+		}
+		for _, v := range strs {
+			if err := f.Value.Set(v); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// splitDomainArg accepts a bare host ("example.com") or a URL ("https://example.com/"),
+// returning the host and the URL's scheme, if any
+func splitDomainArg(arg string) (host, scheme string) {
+	if strings.Contains(arg, "://") {
+		if u, err := url.Parse(arg); err == nil && u.Host != "" {
+			return u.Host, strings.ToLower(u.Scheme)
+		}
+	}
+	return strings.TrimRight(arg, "/"), ""
+}
+
+// diffURLLists prints the URLs added ("+ url") and removed ("- url") between two
+// JS lists, sorted, returning an exit code like diff(1): 0 same, 1 different, 2 error
+func diffURLLists(oldFile, newFile string) int {
+	lists := make([]map[string]bool, 2)
+	for i, name := range []string{oldFile, newFile} {
+		if _, err := os.Stat(name); err != nil {
+			logf(levelError, "%v", err)
+			return 2
+		}
+		urls, err := readURLList(name)
+		if err != nil {
+			logf(levelError, "Read %s: %v", name, err)
+			return 2
+		}
+		lists[i] = map[string]bool{}
+		for _, u := range urls {
+			lists[i][u] = true
+		}
+	}
+	var added, removed []string
+	for u := range lists[1] {
+		if !lists[0][u] {
+			added = append(added, u)
+		}
+	}
+	for u := range lists[0] {
+		if !lists[1][u] {
+			removed = append(removed, u)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	for _, u := range added {
+		fmt.Println("+ " + u)
+	}
+	for _, u := range removed {
+		fmt.Println("- " + u)
+	}
+	logf(levelDebug, "%d added, %d removed", len(added), len(removed))
+	if len(added)+len(removed) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// interruptContext returns a context cancelled by the first Ctrl-C so the run can
+// stop and flush its output; a second Ctrl-C exits immediately
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		logf(levelDebug, "Shutting down gracefully, press Ctrl-C again to force")
+		cancel()
+		<-sigs
+		logf(levelDebug, "Forced exit")
+		os.Exit(130)
+	}()
+	return ctx
+}
+
+// Log levels; OK and FLAG mark tested JS that passed or failed
+const (
+	levelExplain = slog.LevelDebug - 4 // -explain reasons for skipped links
+	levelDebug   = slog.LevelDebug
+	levelOK      = slog.LevelInfo
+	levelFlag    = slog.LevelWarn
+	levelTLS     = slog.LevelWarn + 2 // invalid certificates, see certReport
+	levelError   = slog.LevelError
+)
+
+// jsonLog switches logging to single-line JSON objects when set (-log-json)
+var jsonLog *slog.Logger
+
+// newJSONLogger returns a JSON logger on stdout that names levels like the text tags
+func newJSONLogger() *slog.Logger {
+	return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: levelExplain,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && len(groups) == 0 {
+				a.Value = slog.StringValue(levelName(a.Value.Any().(slog.Level)))
+			}
+			return a
+		},
+	}))
+}
+
+// levelName returns the tag used for level in both log formats
+func levelName(level slog.Level) string {
+	switch level {
+	case levelOK:
+		return "OK"
+	case levelFlag:
+		return "FLAG"
+	case levelTLS:
+		return "TLS"
+	case levelExplain:
+		return "EXPLAIN"
+	case levelError:
+		return "ERROR"
+	}
+	return "DEBUG"
+}
+
+// logf logs a free-form message, e.g. "[DEBUG] Testing JS files..."
+func logf(level slog.Level, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if v := screen.Load(); v != nil {
+		v.log(level, msg)
+		return
+	}
+	if jsonLog != nil {
+		jsonLog.Log(context.Background(), level, msg)
+		return
+	}
+	fmt.Printf("%-6s %s\n", "["+levelName(level)+"]", msg)
+}
+
+// logURL logs an event about u; status and err are included when set
+func logURL(level slog.Level, msg, u string, status int, err error) {
+	if jsonLog != nil {
+		attrs := []slog.Attr{slog.String("url", u)}
+		if status != 0 {
+			attrs = append(attrs, slog.Int("status", status))
+		}
+		if err != nil {
+			attrs = append(attrs, slog.String("error", err.Error()))
+		}
+		if v := screen.Load(); v != nil {
+			v.log(level, urlMessage(msg, u, status, err))
+			return
+		}
+		jsonLog.LogAttrs(context.Background(), level, msg, attrs...)
+		return
+	}
+	logf(level, "%s", urlMessage(msg, u, status, err))
+}
+
+// urlMessage formats a logURL event as text
+func urlMessage(msg, u string, status int, err error) string {
+	switch {
+	case err != nil:
+		return fmt.Sprintf("%s %s: %v", msg, u, err)
+	case status != 0:
+		return fmt.Sprintf("%s returned %d", u, status)
+	}
+	return fmt.Sprintf("%s: %s", msg, u)
+}
+
+// logError logs at the error level, counting the error against this run and copying
+// it to the run's -error-log
+func (c *Crawler) logError(format string, args ...any) {
+	c.teeError(fmt.Sprintf(format, args...))
+	logf(levelError, format, args...)
+}
+
+// logURLError is logURL at the error level, counting and copying it like logError
+func (c *Crawler) logURLError(msg, u string, status int, err error) {
+	c.teeError(urlMessage(msg, u, status, err))
+	logURL(levelError, msg, u, status, err)
+}
+
+// teeError counts an error against this run and copies it to its -error-log file, timestamped
+func (c *Crawler) teeError(msg string) {
+	c.errs.Add(1)
+	if lw := c.errorLog; lw != nil {
+		lw.WriteLine(time.Now().Format(time.RFC3339) + " [ERROR] " + msg)
+	}
+}
+
+// stdoutIsTerminal reports whether stdout is an interactive terminal
+func stdoutIsTerminal() bool {
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// stdinIsTerminal reports whether stdin is an interactive terminal rather than a pipe or file
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err != nil || fi.Mode()&os.ModeCharDevice != 0
+}
+
+// readDomains reads one domain per line, skipping blanks and # comments
+func readDomains(r io.Reader) []string {
+	var domains []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains = append(domains, line)
+	}
+	if err := sc.Err(); err != nil {
+		logf(levelError, "Read stdin: %v", err)
+	}
+	return domains
+}
+
+// Run crawls the domain, writes the discovered JS and tests each file.
+// Cancelling ctx stops the crawl and testing early; whatever was gathered is still written.
+func (c *Crawler) Run(ctx context.Context) error {
+	runStart := time.Now()
+	c.errs.Store(0)
+	// Reset what the summary totals first, so a rejected run doesn't report the last one's
+	c.seen, c.jsSet, c.results = mapSet{}, map[string]string{}, nil
+	defer func() { c.setSummary(time.Since(runStart)) }()
+	if c.SnapshotInterval > 0 && c.Bloom {
+		return errors.New("SnapshotInterval can't be combined with Bloom, whose seen set can't be saved")
+	}
+	ctx, c.trip = context.WithCancel(ctx)
+	defer c.trip()
+	c.errStreak = 0
+	c.throttle = nil
+	if c.AdaptiveDelay {
+		c.throttle = &throttle{min: c.MinDelay, max: c.MaxDelay, delay: c.MinDelay}
+	}
+	c.client = c.Client
+	if c.client == nil {
+		c.client = http.DefaultClient
+	}
+	c.jsClient = c.client
+	if c.StrictJS {
+		noRedirects := *c.client
+		noRedirects.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+		c.jsClient = &noRedirects
+	}
+	if len(c.JSExts) == 0 {
+		c.JSExts = defaultJSExts
+	}
+	if len(c.Extractors) == 0 {
+		c.Extractors = DefaultExtractors()
+	}
+	c.requests.Store(0)
+	if c.Bloom {
+		c.seen = newBloomSet(c.BloomCapacity, c.BloomFPRate)
+	}
+	c.budgetHit.Store(false)
+	c.tlsInfo = map[string]string{}
+	c.protos = map[string]string{}
+	c.durations = map[string]time.Duration{}
+	c.prior = map[string]bool{}
+	c.integrity = map[string]string{}
+	c.sriBad = nil
+	c.suspect = nil
+	c.conns.reset()
+	c.hostSlots = nil
+	if c.PerHostConc > 0 {
+		c.hostSlots = newHostLimiter(c.PerHostConc)
+	}
+	if c.CountOnly {
+		return c.countOnly(ctx)
+	}
+	if c.Append {
+		allFile := c.outputName(fmt.Sprintf("%s_all_js.txt", c.Domain))
+		known, err := readURLList(allFile)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", allFile, err)
+		}
+		for _, js := range known {
+			c.jsSet[js] = ""
+			c.prior[js] = true
+		}
+		if len(known) > 0 {
+			logf(levelDebug, "Loaded %d JS URLs from %s", len(known), allFile)
+		}
+	}
+	c.tested0 = map[string]bool{}
+	// -baseline, -verify-sri and -validate-js look at each body, so they retest everything:
+	// skipping would drop prior JS from the manifest and leave it unchecked
+	if c.Append && !c.RetestAll && c.Baseline == "" && !c.VerifySRI && !c.ValidateJS {
+		// Their classification is already in the appended good/bad files
+		for _, kind := range []string{"good", "bad"} {
+			name := c.outputName(fmt.Sprintf("%s_%s_js.txt", c.Domain, kind))
+			urls, err := readURLList(name)
+			if err != nil {
+				return fmt.Errorf("read %s: %w", name, err)
+			}
+			for _, js := range urls {
+				c.tested0[js] = true
+			}
+		}
+	}
+	c.known, c.newJS = nil, 0
+	if c.KnownJS != "" {
+		// A missing list would make every script "new", so it's an error here
+		if _, err := os.Stat(c.KnownJS); err != nil {
+			return fmt.Errorf("read known JS: %w", err)
+		}
+		known, err := readURLList(c.KnownJS)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", c.KnownJS, err)
+		}
+		c.known = map[string]bool{}
+		for _, js := range known {
+			c.known[c.normalizeURL(js)] = true
+		}
+	}
+	if c.ErrorLog {
+		errFile := fmt.Sprintf("%s_errors.log", c.Domain)
+		w, closeErrs, err := c.createOutput(errFile, true)
+		if err != nil {
+			return fmt.Errorf("create %s: %w", errFile, err)
+		}
+		c.errorLog = newLineWriter(w)
+		defer func() {
+			c.errorLog.Close()
+			c.errorLog = nil
+			closeErrs()
+		}()
+	}
+	c.sink = c.Sink
+	if c.sink == nil {
+		fs, err := newFileSink(c)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := fs.Close(); err != nil {
+				c.logError("%v", err)
+			}
+		}()
+		c.sink = fs
+	}
+
+	start := time.Now()
+	c.certs.reset()
+	defer c.writeCertProblems()
+	if c.TUI {
+		if stdoutIsTerminal() {
+			screen.Store(newTUIView(c.Domain, &c.requests, &c.errs))
+			defer stopTUI()
+		} else {
+			logf(levelDebug, "stdout isn't a terminal; -tui falls back to the line log")
+		}
+	}
+	if c.NotifyURL != "" {
+		defer func() { c.notify(time.Since(start)) }()
+	}
+	if c.SummaryJSON {
+		defer func() { c.writeSummaryJSON(time.Since(start)) }()
+	}
+
+	crawlCtx, cancelCrawl := phaseContext(ctx, c.CrawlTimeout)
+	c.crawl(crawlCtx)
+	if errors.Is(crawlCtx.Err(), context.DeadlineExceeded) {
+		logf(levelDebug, "Crawl timeout of %s reached", c.CrawlTimeout)
+	}
+	cancelCrawl()
+	crawlElapsed := time.Since(start)
+
+	if c.TLSInfo {
+		defer c.writeTLSInfo()
+	}
+	if c.GraphOutput != "" {
+		if err := c.writeGraph(); err != nil {
+			return err
+		}
+	}
+	if c.PagesOutput != "" {
+		if err := c.writePages(); err != nil {
+			return err
+		}
+	}
+
+	if len(c.jsSet) == 0 {
+		logf(levelDebug, "No JS files found; exiting.")
+		c.emptyHint()
+		logf(levelDebug, "Completed in %.1fs (pages: %d @ %.1f/s)",
+			crawlElapsed.Seconds(), c.seen.Len(), rate(c.seen.Len(), crawlElapsed))
+		return nil
+	}
+
+	if c.ConfigJS != nil {
+		if err := c.writeConfigJS(); err != nil {
+			return err
+		}
+	}
+	if c.known != nil {
+		if err := c.writeNewJS(); err != nil {
+			return err
+		}
+	}
+
+	if c.PhaseDelay > 0 {
+		logf(levelDebug, "Pausing %s before testing JS files", c.PhaseDelay)
+		select {
+		case <-time.After(c.PhaseDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	if c.Baseline != "" {
+		baseline, err := readManifest(c.Baseline)
+		if err != nil {
+			return fmt.Errorf("read baseline %s: %w", c.Baseline, err)
+		}
+		c.baseline = baseline
+		c.hashes = map[string]string{}
+	}
+
+	testStart := time.Now()
+	testCtx, cancelTest := phaseContext(ctx, c.TestTimeout)
+	defer cancelTest()
+	if err := c.testJS(testCtx); err != nil {
+		return err
+	}
+	if errors.Is(testCtx.Err(), context.DeadlineExceeded) {
+		logf(levelDebug, "Test timeout of %s reached", c.TestTimeout)
+	}
+	stopTUI()
+	if c.ReportSlow > 0 {
+		c.reportSlowest(c.ReportSlow)
+	}
+	if c.Baseline != "" {
+		if err := c.writeChanges(); err != nil {
+			return err
+		}
+	}
+	if c.VerifySRI {
+		if err := c.writeSRIMismatches(); err != nil {
+			return err
+		}
+	}
+	if c.ValidateJS {
+		if err := c.writeSuspectJS(); err != nil {
+			return err
+		}
+	}
+	if c.CollapseHash != nil {
+		if err := c.writeCollapsed(); err != nil {
+			return err
+		}
+	}
+	testElapsed := time.Since(testStart)
+	elapsed := time.Since(start)
+
+	logf(levelDebug, "Pages visited: %d, JS files found: %d", c.seen.Len(), len(c.jsSet))
+	if c.RespectRobots {
+		logf(levelDebug, "Pages marked noindex: %d", c.noindex)
+	}
+	if c.RoutesFromJS {
+		logf(levelDebug, "Pages queued from JS routes: %d", c.routes)
+	}
+	if !c.Since.IsZero() {
+		logf(levelDebug, "Pages unchanged since %s: %d", c.Since.Format(time.RFC3339), c.unchanged)
+	}
+	logf(levelDebug, "JS hosts: %s", jsHostSummary(c.jsSet))
+	logf(levelDebug, "Completed in %.1fs (pages: %d @ %.1f/s, js tested: %d @ %.1f/s, requests: %d @ %.1f/s)",
+		elapsed.Seconds(), c.seen.Len(), rate(c.seen.Len(), crawlElapsed), c.tested, rate(c.tested, testElapsed),
+		c.requests.Load(), rate(int(c.requests.Load()), elapsed))
+	if c.ConnStats {
+		c.conns.log()
+	}
+
+	switch c.Format {
+	case "html":
+		if err := c.writeHTMLReport(elapsed); err != nil {
+			return err
+		}
+	case "json":
+		if err := c.writeJSONReport(elapsed); err != nil {
+			return err
+		}
+	}
+	if c.FailOnNew && c.newJS > 0 {
+		return fmt.Errorf("%d JS files not in %s", c.newJS, c.KnownJS)
+	}
+	return nil
+}
+
+// countOnly crawls and prints the page and JS counts, without testing or writing anything
+func (c *Crawler) countOnly(ctx context.Context) error {
+	c.sink = discardSink{}
+	start := time.Now()
+	crawlCtx, cancelCrawl := phaseContext(ctx, c.CrawlTimeout)
+	defer cancelCrawl()
+	c.crawl(crawlCtx)
+	elapsed := time.Since(start)
+
+	logf(levelDebug, "Pages visited: %d, JS files found: %d", c.seen.Len(), len(c.jsSet))
+	if len(c.jsSet) > 0 {
+		logf(levelDebug, "JS hosts: %s", jsHostSummary(c.jsSet))
+	} else {
+		c.emptyHint()
+	}
+	logf(levelDebug, "Completed in %.1fs (pages: %d @ %.1f/s)",
+		elapsed.Seconds(), c.seen.Len(), rate(c.seen.Len(), elapsed))
+	if c.ConnStats {
+		c.conns.log()
+	}
+	return nil
+}
+
+// notify POSTs a JSON summary of the run to NotifyURL; failures are only logged
+func (c *Crawler) notify(elapsed time.Duration) {
+	_, bad, _ := c.goodBad()
+	body, err := json.Marshal(map[string]any{
+		"domain":   c.Domain,
+		"pages":    c.seen.Len(),
+		"js_found": len(c.jsSet),
+		"tested":   c.tested,
+		"bad":      bad,
+		"seconds":  elapsed.Seconds(),
+	})
+	if err != nil {
+		logf(levelFlag, "Notify: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.NotifyURL, bytes.NewReader(body))
+	if err != nil {
+		logf(levelFlag, "Notify: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		logf(levelFlag, "Notify %s: %v", c.NotifyURL, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		logf(levelFlag, "Notify %s returned %d", c.NotifyURL, resp.StatusCode)
+		return
+	}
+	logf(levelDebug, "Notified %s", c.NotifyURL)
+}
+
+// Summary returns the totals of the last Run, which are complete once it returns,
+// however it ended. It's safe to call from any goroutine.
+func (c *Crawler) Summary() Summary {
+	c.summaryMu.Lock()
+	defer c.summaryMu.Unlock()
+	s := c.summary
+	s.StatusCounts = maps.Clone(s.StatusCounts)
+	return s
+}
+
+// setSummary records the run totals returned by Summary
+func (c *Crawler) setSummary(elapsed time.Duration) {
+	s := c.summarize(elapsed)
+	c.summaryMu.Lock()
+	c.summary = s
+	c.summaryMu.Unlock()
+}
+
+// summarize totals the run so far from the same counters the closing log lines use
+func (c *Crawler) summarize(elapsed time.Duration) Summary {
+	s := Summary{JSFound: len(c.jsSet), Errors: c.errs.Load(), Duration: elapsed, StatusCounts: map[int]int{}}
+	if c.seen != nil {
+		s.PagesVisited = c.seen.Len()
+	}
+	s.Good, s.Bad, s.Suspect = c.goodBad()
+	for _, r := range c.results {
+		s.StatusCounts[r.Status]++
+	}
+	return s
+}
+
+// writeSummaryJSON writes the run totals to <domain>_summary.json
+func (c *Crawler) writeSummaryJSON(elapsed time.Duration) {
+	summaryFile := fmt.Sprintf("%s_summary.json", c.Domain)
+	s := c.summarize(elapsed)
+	data, err := json.MarshalIndent(map[string]any{
+		"domain":           c.Domain,
+		"pages_visited":    s.PagesVisited,
+		"js_found":         s.JSFound,
+		"good":             s.Good,
+		"bad":              s.Bad,
+		"suspect":          s.Suspect,
+		"errors":           s.Errors,
+		"duration_seconds": elapsed.Seconds(),
+	}, "", "  ")
+	if err == nil {
+		err = c.writeFile(summaryFile, append(data, '\n'))
+	}
+	if err != nil {
+		c.logError("Write %s: %v", summaryFile, err)
+		return
+	}
+	logf(levelDebug, "Summary in %s", summaryFile)
+}
+
+// goodBad counts the recorded test results that were good, bad and suspect
+func (c *Crawler) goodBad() (good, bad, suspect int) {
+	for _, r := range c.results {
+		switch {
+		case r.Suspect:
+			suspect++
+		case r.OK:
+			good++
+		default:
+			bad++
+		}
+	}
+	return good, bad, suspect
+}
+
+// phaseContext derives a context for one phase, bounded by timeout when it is set
+func phaseContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// inScope reports whether link may be crawled: on the crawl host or a -scope glob
+// (and scheme, with -same-origin) and, with -path-prefix, under one of the prefixes
+func (c *Crawler) inScope(link string) bool {
+	return c.scopeReason(link) == ""
+}
+
+// scopeReason returns why link is out of scope, or "" if it's in scope
+func (c *Crawler) scopeReason(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "unparseable URL"
+	}
+	if !sameDomain(link, c.host) && !c.scopeMatch(u) && !(c.SeedBothWWW && isWWWVariant(u.Host, c.host)) {
+		return "off-domain"
+	}
+	if c.SameOrigin && !strings.EqualFold(u.Scheme, c.scheme) {
+		return "different scheme under -same-origin"
+	}
+	if len(c.PathPrefixes) == 0 {
+		return ""
+	}
+	for _, prefix := range c.PathPrefixes {
+		if strings.HasPrefix(u.Path, prefix) {
+			return ""
+		}
+	}
+	return "outside -path-prefix"
+}
+
+// shouldQueue reports whether link found on page should be crawled: in scope, not yet
+// seen and within -depth-per-host. Under -explain the reason for a "no" is logged.
+func (c *Crawler) shouldQueue(page, link string) bool {
+	reason := c.scopeReason(link)
+	switch {
+	case reason != "":
+	case c.seen.Has(link):
+		reason = "already seen"
+	case !c.withinDepth(page, link):
+		reason = "over -depth-per-host"
+	}
+	if reason != "" {
+		c.explain(link, reason)
+	}
+	return reason == ""
+}
+
+// explain logs why link was skipped when -explain is on
+func (c *Crawler) explain(link, reason string) {
+	if c.Explain {
+		logf(levelExplain, "Skipped %s: %s", link, reason)
+	}
+}
+
+// scopeMatch reports whether u's host matches one of the -scope globs. Patterns with
+// a port are matched against host:port, others against the bare hostname.
+func (c *Crawler) scopeMatch(u *url.URL) bool {
+	if u.Scheme == "" {
+		return false
+	}
+	for _, pattern := range c.Scope {
+		host := strings.ToLower(u.Hostname())
+		if strings.Contains(pattern, ":") {
+			host = strings.ToLower(u.Host)
+		}
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// urlSet records which URLs the crawl has already seen
+type urlSet interface {
+	Add(u string)
+	Has(u string) bool
+	Len() int // URLs added, counting each distinct URL once
+}
+
+// mapSet is the exact urlSet used by default
+type mapSet map[string]bool
+
+func (s mapSet) Add(u string)      { s[u] = true }
+func (s mapSet) Has(u string) bool { return s[u] }
+func (s mapSet) Len() int          { return len(s) }
+
+// bloomSet is a fixed-size urlSet for -bloom. Has may return true for a URL never
+// added (a false positive), so a few pages can be missed, but it never returns false
+// for one that was added, so no page is fetched twice.
+type bloomSet struct {
+	bits []uint64
+	m, k uint64
+	n    int
+}
+
+// newBloomSet sizes a filter for capacity URLs at false-positive rate fp
+func newBloomSet(capacity int, fp float64) *bloomSet {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if fp <= 0 || fp >= 1 {
+		fp = 0.001
+	}
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(fp) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(capacity)*math.Ln2)))
+	return &bloomSet{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+// positions derives the k bit positions of u by double hashing two FNV hashes
+func (s *bloomSet) positions(u string) []uint64 {
+	h1, h2 := fnv.New64a(), fnv.New64()
+	h1.Write([]byte(u))
+	h2.Write([]byte(u))
+	a, b := h1.Sum64(), h2.Sum64()|1
+	pos := make([]uint64, s.k)
+	for i := range pos {
+		pos[i] = (a + uint64(i)*b) % s.m
+	}
+	return pos
+}
+
+func (s *bloomSet) Add(u string) {
+	added := false
+	for _, p := range s.positions(u) {
+		if s.bits[p/64]&(1<<(p%64)) == 0 {
+			s.bits[p/64] |= 1 << (p % 64)
+			added = true
+		}
+	}
+	if added {
+		s.n++
+	}
+}
+
+func (s *bloomSet) Has(u string) bool {
+	for _, p := range s.positions(u) {
+		if s.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Len estimates distinct URLs added; URLs colliding with earlier ones aren't counted
+func (s *bloomSet) Len() int { return s.n }
+
+// connCounts tallies connection use via httptrace. The hooks may run on transport
+// goroutines, hence the atomics.
+type connCounts struct {
+	fresh, reused, lookups atomic.Int64
+}
+
+func (n *connCounts) reset() {
+	n.fresh.Store(0)
+	n.reused.Store(0)
+	n.lookups.Store(0)
+}
+
+// trace returns hooks that count each connection obtained and each DNS lookup
+func (n *connCounts) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				n.reused.Add(1)
+			} else {
+				n.fresh.Add(1)
+			}
+		},
+		DNSStart: func(httptrace.DNSStartInfo) { n.lookups.Add(1) },
+	}
+}
+
+// log prints the tallies, e.g. "Connections: 12 new, 340 reused (97% reused), DNS lookups: 12"
+func (n *connCounts) log() {
+	fresh, reused := n.fresh.Load(), n.reused.Load()
+	pct := 0.0
+	if total := fresh + reused; total > 0 {
+		pct = 100 * float64(reused) / float64(total)
+	}
+	logf(levelDebug, "Connections: %d new, %d reused (%.0f%% reused), DNS lookups: %d", fresh, reused, pct, n.lookups.Load())
+}
+
+// takeRequest reserves one request from the -max-requests budget, reporting false once it is spent
+func (c *Crawler) takeRequest() bool {
+	n := c.requests.Add(1)
+	if c.MaxRequests > 0 && n > int64(c.MaxRequests) {
+		c.requests.Add(-1)
+		if c.budgetHit.CompareAndSwap(false, true) {
+			logf(levelDebug, "Request budget of %d hit; finishing with what was fetched", c.MaxRequests)
+		}
+		return false
+	}
+	return true
+}
+
+// defaultRetryAfter is the cooldown after a 429 that has no usable Retry-After header
+const defaultRetryAfter = 30 * time.Second
+
+// cooldown is a shared "paused until" time that every request waits out, so one
+// 429 backs off the whole run rather than just the URL that hit it
+type cooldown struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// rateLimit is the cooldown shared by page and JS requests
+var rateLimit cooldown
+
+// pause extends the cooldown to at least d from now
+func (cd *cooldown) pause(d time.Duration) {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+	if t := time.Now().Add(d); t.After(cd.until) {
+		cd.until = t
+	}
+}
+
+// wait blocks until the cooldown is over or ctx is done
+func (cd *cooldown) wait(ctx context.Context) error {
+	cd.mu.Lock()
+	d := time.Until(cd.until)
+	cd.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttleBase is where -adaptive-delay starts backing off from when the delay is 0,
+// and how much each success takes off the delay
+const throttleBase = 250 * time.Millisecond
+
+// throttle is the AIMD controller behind -adaptive-delay: the delay before each request
+// doubles on a block (403, 429, 503) and drops by throttleBase on any other response,
+// staying within [min, max]. It's shared by concurrent requests.
+type throttle struct {
+	mu       sync.Mutex
+	min, max time.Duration
+	delay    time.Duration
+}
+
+// wait sleeps for the current delay, or until ctx is done
+func (t *throttle) wait(ctx context.Context) error {
+	t.mu.Lock()
+	d := t.delay
+	t.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// observe adjusts the delay for a response status
+func (t *throttle) observe(status int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prev := t.delay
+	if blockedStatus(status) || status == http.StatusTooManyRequests {
+		t.delay = min(max(2*t.delay, throttleBase), t.max)
+		if t.delay != prev {
+			logf(levelFlag, "Got %d; slowing down to %s between requests", status, t.delay)
+		}
+		return
+	}
+	t.delay = max(t.delay-throttleBase, t.min)
+	if t.delay != prev && t.delay == t.min {
+		logf(levelDebug, "Requests healthy again; delay back to %s", t.delay)
+	}
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date
+func retryAfter(v string) time.Duration {
+	if secs, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return defaultRetryAfter
+}
+
+// do sends req with client, first taking one of its host's slots under PerHostConc.
+// The slot is held until the response body is closed, so callers must always close it.
+func (c *Crawler) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	if c.hostSlots == nil {
+		return c.send(client, req)
+	}
+	release, err := c.hostSlots.acquire(req.Context(), req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.send(client, req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: sync.OnceFunc(release)}
+	return resp, nil
+}
+
+// releaseOnClose gives back a host slot when the response body is closed
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseOnClose) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
+
+// hostLimiter hands out a fixed number of request slots per host
+type hostLimiter struct {
+	mu    sync.Mutex
+	limit int
+	slots map[string]chan struct{}
+}
+
+func newHostLimiter(limit int) *hostLimiter {
+	return &hostLimiter{limit: limit, slots: map[string]chan struct{}{}}
+}
+
+// acquire waits for a free slot on host; release gives it back
+func (l *hostLimiter) acquire(ctx context.Context, host string) (release func(), err error) {
+	l.mu.Lock()
+	sem, ok := l.slots[host]
+	if !ok {
+		sem = make(chan struct{}, l.limit)
+		l.slots[host] = sem
+	}
+	l.mu.Unlock()
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// send sends req with client once any cooldown is over. A 429 starts a cooldown for every request,
+// honoring Retry-After, and req is retried once after it if the request budget allows.
+func (c *Crawler) send(client *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := c.attempt(client, req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+	d := retryAfter(resp.Header.Get("Retry-After"))
+	rateLimit.pause(d)
+	logf(levelFlag, "Rate limited on %s; pausing all requests for %s", req.URL, d)
+	// The first attempt consumed any body; without GetBody it can't be sent again
+	if (req.Body != nil && req.GetBody == nil) || !c.takeRequest() {
+		return resp, nil
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry.Body = body
+	}
+	resp.Body.Close()
+	return c.attempt(client, retry)
+}
+
+// attempt sends req once, after any rate-limit pause and adaptive delay, and records
+// what the response shows: throttle feedback, certificate problems and the protocol
+func (c *Crawler) attempt(client *http.Client, req *http.Request) (*http.Response, error) {
+	if err := rateLimit.wait(req.Context()); err != nil {
+		return nil, err
+	}
+	if c.throttle != nil {
+		if err := c.throttle.wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+	if c.ConnStats {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), c.conns.trace()))
+	}
+	if c.userAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	resp, err := client.Do(req)
+	if err == nil && c.throttle != nil {
+		c.throttle.observe(resp.StatusCode)
+	}
+	if certErr := certError(err); certErr != nil {
+		c.certs.record(req.URL.Hostname(), certErr)
+	} else if err == nil && resp.TLS != nil {
+		c.certs.check(req.URL.Hostname(), resp.TLS)
+	}
+	if err == nil && c.LogProto {
+		c.logProto(resp)
+	}
+	return resp, err
+}
+
+// crawl visits every same-domain page reachable from the root and collects JS URLs
+func (c *Crawler) crawl(ctx context.Context) {
+	c.host = bracketIPv6(c.Domain)
+	c.scheme = c.Scheme
+	root := fmt.Sprintf("%s://%s/", c.Scheme, c.host)
+	queue := []string{root}
+	if len(c.PathPrefixes) > 0 {
+		// Seed from each prefix rather than the site root
+		queue = queue[:0]
+		for _, prefix := range c.PathPrefixes {
+			queue = append(queue, fmt.Sprintf("%s://%s%s", c.Scheme, c.host, prefix))
+		}
+		root = queue[0]
+	}
+	logURL(levelDebug, "Starting crawl", root, 0, nil)
+	if variant := wwwVariant(c.host); c.SeedBothWWW && variant != "" {
+		for _, seed := range queue {
+			u, _ := url.Parse(seed)
+			u.Host = variant
+			logURL(levelDebug, "Also seeding", u.String(), 0, nil)
+			queue = append(queue, u.String())
+		}
+	}
+
+	c.unchanged = 0
+	c.fetched, c.rootStat, c.userAgent = 0, 0, ""
+	c.browser = ""
+	if c.Headless {
+		if c.browser = findBrowser(c.HeadlessBin); c.browser == "" {
+			logf(levelFlag, "No Chrome/Chromium found for -headless; parsing static HTML instead")
+		} else {
+			logf(levelDebug, "Rendering pages with %s", c.browser)
+		}
+	}
+	c.cssSeen = map[string]bool{}
+	c.formsSeen = map[string]bool{}
+	if c.CrawlForms && c.StreamParse {
+		// Submitting forms without their fields (CSRF tokens included) would only fail
+		logf(levelFlag, "Not submitting forms: -crawl-forms needs a full parse, not -stream-parse")
+	}
+	c.noindex = 0
+	c.routes = 0
+	c.depth = map[string]int{}
+	c.graph = nil
+	if c.GraphOutput != "" {
+		c.graph = map[string][]string{}
+	}
+	c.pages = nil
+	if c.PagesOutput != "" {
+		c.pages = map[string]bool{}
+	}
+	for _, seed := range queue {
+		c.seen.Add(seed)
+	}
+
+	var current string // page being crawled, kept in the final snapshot if the crawl stops mid-page
+	snapshots := c.SnapshotInterval > 0 && !c.CountOnly
+	if snapshots {
+		snapFile := fmt.Sprintf("%s_snapshot.json", c.Domain)
+		snap, err := loadSnapshot(snapFile)
+		if err != nil {
+			c.logError("Load %s: %v", snapFile, err)
+		}
+		if snap != nil {
+			c.resume(snap)
+			queue = snap.Queue
+			logf(levelDebug, "Resuming from %s: %d pages queued, %d seen, %d JS", snapFile, len(queue), c.seen.Len(), len(c.jsSet))
+		}
+		state := func() crawlSnapshot {
+			return crawlSnapshot{Host: c.host, Scheme: c.scheme, Queue: queue, Seen: c.seen.(mapSet).urls(), JS: c.jsSet, Depth: c.depth}
+		}
+		c.stateMu.Lock()
+		stop := c.startSnapshots(snapFile, state)
+		defer func() {
+			c.stateMu.Unlock()
+			stop()
+			// A finished crawl has nothing to resume; an interrupted one saves where it
+			// stopped, including the page it was on
+			stopped := ctx.Err() != nil || c.budgetHit.Load()
+			if len(queue) == 0 && !stopped {
+				os.Remove(snapFile)
+				return
+			}
+			snap := state()
+			if stopped && current != "" {
+				if c.Order == "dfs" {
+					snap.Queue = append(snap.Queue, current)
+				} else {
+					snap.Queue = append([]string{current}, snap.Queue...)
+				}
+			}
+			if err := saveSnapshot(snapFile, snap); err != nil {
+				c.logError("Save %s: %v", snapFile, err)
+			}
+		}()
+	}
+
+	for len(queue) > 0 {
+		current = ""
+		if snapshots {
+			// Let a pending snapshot in between pages
+			c.stateMu.Unlock()
+			c.stateMu.Lock()
+		}
+		if ctx.Err() != nil {
+			logf(levelDebug, "Crawl interrupted with %d pages queued", len(queue))
+			return
+		}
+		// BFS takes from the front; DFS uses the queue as a stack
+		var page string
+		if c.Order == "dfs" {
+			page, queue = queue[len(queue)-1], queue[:len(queue)-1]
+		} else {
+			page, queue = queue[0], queue[1:]
+		}
+		current = page
+		logURL(levelDebug, "Crawling page", page, 0, nil)
+		if v := screen.Load(); v != nil {
+			v.crawling(page, len(queue), c.seen.Len(), len(c.jsSet))
+		}
+
+		req, err := c.newPageRequest(ctx, page)
+		if err != nil {
+			c.logURLError("Request", page, 0, err)
+			continue
+		}
+		if !c.takeRequest() {
+			break
+		}
+		resp, err := c.do(c.client, req)
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			c.logURLError("Fetch", page, 0, err)
+			c.countFetch(0)
+			continue
+		}
+		if resp.StatusCode == http.StatusNotFound && c.RetrySlash {
+			resp = c.retryWithSlash(ctx, page, resp)
+		}
+		if page == root && c.AutoUA && c.userAgent == "" && blockedStatus(resp.StatusCode) {
+			resp = c.retryAsBrowser(ctx, page, resp)
+		}
+		if page == root {
+			c.rootStat = resp.StatusCode
+		}
+		c.countFetch(resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		// Legacy servers may cut the body short or garble chunked encoding; what did
+		// arrive is still worth parsing
+		if err != nil && (len(body) == 0 || ctx.Err() != nil) {
+			c.logURLError("Read", page, 0, err)
+			continue
+		}
+		if err != nil {
+			logf(levelFlag, "Partial read of %s (%d bytes) before: %v; parsing what arrived", page, len(body), err)
+		}
+		// Resolve against where redirects actually landed
+		final := resp.Request.URL
+		if page == root && final.Host != c.host && isWWWVariant(final.Host, c.host) {
+			logf(levelDebug, "Root redirected to %s; crawling it as the canonical host", final.Host)
+			c.host = final.Host
+		}
+		base := final.String()
+		c.seen.Add(base)
+		if page == root {
+			if sameHost(final.Host, c.host) {
+				c.scheme = final.Scheme
+			}
+			c.recordTLS(final.Host, resp.TLS)
+		}
+
+		if resp.StatusCode == http.StatusNotModified && !c.Since.IsZero() {
+			logURL(levelDebug, "Unchanged since -since, skipping", base, 0, nil)
+			c.unchanged++
+			c.fetched++
+			if c.pages != nil {
+				c.pages[base] = true
+			}
+			continue
+		}
+		// Non-2xx pages (WAF blocks, 404s, server errors) aren't parsed
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			logURL(levelFlag, "Page", base, resp.StatusCode, nil)
+			if c.SaveErrors && !c.CountOnly {
+				c.saveErrorPage(base, resp.StatusCode, body)
+			}
+			continue
+		}
+		c.fetched++
+		if c.pages != nil {
+			c.pages[base] = true
+		}
+
+		content := decodeBody(body, resp.Header.Get("Content-Type"))
+		var requested []string // URLs the rendered page loaded
+		if c.browser != "" && c.takeRequest() {
+			if dom, urls, err := c.render(ctx, base); err != nil {
+				c.logURLError("Render", base, 0, err)
+			} else {
+				content, requested = dom, urls
+			}
+		}
+		parse := html.Parse
+		if c.StreamParse {
+			parse = streamParse
+		}
+		doc, err := parse(strings.NewReader(content))
+		if err != nil {
+			c.logURLError("Parse HTML", base, 0, err)
+			continue
+		}
+		// Relative URLs in the page resolve against its <base href>, if any
+		docBase := base
+		if href := baseHref(ctx, doc); href != "" && !c.IgnoreBase {
+			if b := resolveURL(base, href); b != "" {
+				docBase = b
+			}
+		}
+
+		// A duplicate page's canonical URL needn't be crawled again and owns its JS
+		ref := base
+		if c.RespectCanonical {
+			if canon := c.normalizeURL(resolveURL(docBase, canonicalHref(ctx, doc))); canon != "" && canon != base && c.inScope(canon) {
+				c.seen.Add(canon)
+				ref = canon
+			}
+		}
+
+		// Extract JS URLs, including scripts only declared in Link preload headers and
+		// those a rendered page loaded without a tag
+		found := append(linkHeaderJS(resp.Header, base, c.JSExts), extractJS(ctx, doc, docBase, c.JSExts, c.Extractors)...)
+		for _, u := range requested {
+			if hasJSExt(u, c.JSExts) {
+				found = append(found, u)
+			}
+		}
+		for _, js := range found {
+			if !c.addJS(js, ref) || !c.RoutesFromJS || c.NoCrawl {
+				continue
+			}
+			for _, link := range c.jsRoutes(ctx, js) {
+				if c.routes < maxJSRoutes && c.shouldQueue(page, link) {
+					c.seen.Add(link)
+					c.routes++
+					queue = append(queue, link)
+				}
+			}
+		}
+		if c.ScanJSONBlocks {
+			for _, u := range jsonBlockURLs(ctx, doc, docBase) {
+				switch {
+				case hasJSExt(u, c.JSExts):
+					c.addJS(u, ref)
+				case c.NoCrawl:
+				default:
+					link := c.normalizeURL(u)
+					if pu, err := url.Parse(link); err == nil && routeLike(pu.Path) && c.shouldQueue(page, link) {
+						c.seen.Add(link)
+						queue = append(queue, link)
+					}
+				}
+			}
+		}
+		if c.ScanCSS {
+			for _, sheet := range stylesheets(ctx, doc, docBase) {
+				if !c.cssSeen[sheet] {
+					c.cssSeen[sheet] = true
+					c.scanCSS(ctx, sheet)
+				}
+			}
+		}
+		if c.VerifySRI {
+			for js, sri := range scriptIntegrity(ctx, doc, docBase) {
+				if _, ok := c.integrity[js]; !ok {
+					c.integrity[js] = sri
+				}
+			}
+		}
+		// Extract links
+		if c.NoCrawl {
+			continue
+		}
+		// Client-side redirects are followed like HTTP ones
+		if target := metaRefresh(ctx, doc); target != "" {
+			link := c.normalizeURL(resolveURL(docBase, target))
+			if c.shouldQueue(page, link) {
+				logf(levelDebug, "Following meta refresh from %s to %s", base, link)
+				c.seen.Add(link)
+				queue = append(queue, link)
+			}
+		}
+		if c.RespectRobots {
+			noindex, nofollow := metaRobots(ctx, doc)
+			if noindex {
+				logURL(levelDebug, "Page is noindex", base, 0, nil)
+				c.noindex++
+			}
+			if nofollow {
+				logURL(levelDebug, "Page is nofollow, not following its links", base, 0, nil)
+				continue
+			}
+		}
+		var links []string
+		if c.CrawlForms && !c.StreamParse {
+			for _, f := range postForms(ctx, doc, docBase) {
+				if !c.formsSeen[f.action] {
+					c.formsSeen[f.action] = true
+					links = append(links, c.submitForm(ctx, page, f)...)
+				}
+			}
+		}
+		edges := map[string]bool{}
+		if c.graph != nil && c.graph[base] == nil {
+			c.graph[base] = []string{}
+		}
+		rules := c.Links
+		if c.Explain {
+			rules.OnSkip = c.explain
+		}
+		for _, link := range extractLinks(ctx, doc, docBase, rules) {
+			link = c.normalizeURL(link)
+			if c.graph != nil && c.inScope(link) && !edges[link] {
+				edges[link] = true
+				c.graph[base] = append(c.graph[base], link)
+			}
+			if c.shouldQueue(page, link) {
+				c.seen.Add(link)
+				links = append(links, link)
+			}
+		}
+		// Sorted so the order is reproducible; reversed for DFS so the first link is popped first
+		sort.Strings(links)
+		if c.Order == "dfs" {
+			for i, j := 0, len(links)-1; i < j; i, j = i+1, j-1 {
+				links[i], links[j] = links[j], links[i]
+			}
+		}
+		queue = append(queue, links...)
+	}
+}
+
+// writePages writes the pages fetched OK to PagesOutput, sorted
+func (c *Crawler) writePages() error {
+	pages := make([]string, 0, len(c.pages))
+	for p := range c.pages {
+		pages = append(pages, p)
+	}
+	sort.Strings(pages)
+	var buf bytes.Buffer
+	for _, p := range pages {
+		buf.WriteString(p + "\n")
+	}
+	if err := c.writeFile(c.PagesOutput, buf.Bytes()); err != nil {
+		return fmt.Errorf("write %s: %w", c.PagesOutput, err)
+	}
+	logf(levelDebug, "%d fetched pages in %s", len(pages), c.PagesOutput)
+	return nil
+}
+
+// writeGraph writes the link graph to GraphOutput; pages without in-scope links map to []
+func (c *Crawler) writeGraph() error {
+	for page, links := range c.graph {
+		sort.Strings(links)
+		c.graph[page] = links
+	}
+	data, err := json.MarshalIndent(c.graph, "", "  ")
+	if err == nil {
+		err = c.writeFile(c.GraphOutput, append(data, '\n'))
+	}
+	if err != nil {
+		return fmt.Errorf("write %s: %w", c.GraphOutput, err)
+	}
+	logf(levelDebug, "Link graph of %d pages in %s", len(c.graph), c.GraphOutput)
+	return nil
+}
+
+// headlessBrowsers are the executables -headless looks for on PATH
+var headlessBrowsers = []string{"chromium", "chromium-browser", "google-chrome", "google-chrome-stable", "chrome"}
+
+// findBrowser returns bin resolved on PATH, or the first headlessBrowsers entry found
+// when bin is empty; "" means rendering isn't available
+func findBrowser(bin string) string {
+	names := headlessBrowsers
+	if bin != "" {
+		names = []string{bin}
+	}
+	for _, name := range names {
+		if p, err := exec.LookPath(name); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// render loads page in the headless browser and returns its DOM once scripts have had
+// HeadlessWait of virtual time, so script tags inserted by loaders and chunk runtimes
+// are included, along with every URL the page requested, read from the browser's net
+// log, so chunks loaded by import() or XHR that never become tags are too. The browser
+// fetches the page again and uses its own network stack: -proxy-file, -resolve and
+// cookies don't apply to renders.
+func (c *Crawler) render(ctx context.Context, page string) (dom string, requested []string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, c.HeadlessWait+30*time.Second)
+	defer cancel()
+	netLog, err := os.CreateTemp("", "jscrawl-netlog-*.json")
+	if err != nil {
+		return "", nil, err
+	}
+	netLog.Close()
+	defer os.Remove(netLog.Name())
+	args := []string{"--headless=new", "--disable-gpu", "--mute-audio",
+		fmt.Sprintf("--virtual-time-budget=%d", c.HeadlessWait.Milliseconds()), "--dump-dom",
+		"--log-net-log=" + netLog.Name()}
+	if c.userAgent != "" {
+		args = append(args, "--user-agent="+c.userAgent)
+	}
+	out, err := exec.CommandContext(ctx, c.browser, append(args, page)...).Output()
+	if err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && len(exit.Stderr) > 0 {
+			return "", nil, fmt.Errorf("%w: %s", err, truncate(strings.TrimSpace(string(exit.Stderr)), 200))
+		}
+		return "", nil, err
+	}
+	if data, err := os.ReadFile(netLog.Name()); err == nil {
+		requested = netLogURLs(data)
+	}
+	return string(out), requested, nil
+}
+
+// netLogURL matches a "url" string in a Chrome net log
+var netLogURL = regexp.MustCompile(`"url":\s*("(?:[^"\\]|\\.)*")`)
+
+// netLogURLs returns the distinct http(s) URLs requested in a Chrome net log. The log
+// is scanned rather than decoded, since a browser that is cut off leaves it unterminated.
+func netLogURLs(data []byte) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, m := range netLogURL.FindAllSubmatch(data, -1) {
+		var u string
+		if json.Unmarshal(m[1], &u) != nil || seen[u] {
+			continue
+		}
+		seen[u] = true
+		if strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// withinDepth records the depth of link found on page and reports whether it is within
+// -depth-per-host. Depth counts hops on one host and restarts at 0 when a link changes host.
+func (c *Crawler) withinDepth(page, link string) bool {
+	if c.DepthPerHost <= 0 {
+		return true
+	}
+	d := 0
+	if pu, err := url.Parse(page); err == nil && sameDomain(link, pu.Host) {
+		d = c.depth[page] + 1
+	}
+	if d > c.DepthPerHost {
+		return false
+	}
+	c.depth[link] = d
+	return true
+}
+
+// addJS records a discovered JS URL with the page that referenced it, reporting
+// whether it was new
+func (c *Crawler) addJS(js, ref string) bool {
+	js = c.normalizeURL(js)
+	if _, ok := c.jsSet[js]; ok {
+		return false
+	}
+	c.jsSet[js] = ref
+	c.sink.WriteAll(js)
+	if c.OnJSFound != nil {
+		c.OnJSFound(js)
+	}
+	return true
+}
+
+// crawlSnapshot is the crawl progress saved by -snapshot-interval
+type crawlSnapshot struct {
+	Host   string            `json:"host"`
+	Scheme string            `json:"scheme"`
+	Queue  []string          `json:"queue"`
+	Seen   []string          `json:"seen"`
+	JS     map[string]string `json:"js"` // JS URL -> referring page
+	Depth  map[string]int    `json:"depth,omitempty"`
+}
+
+// urls returns the set's URLs, sorted
+func (s mapSet) urls() []string {
+	out := make([]string, 0, len(s))
+	for u := range s {
+		out = append(out, u)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// loadSnapshot reads a saved snapshot; a missing file yields nil
+func loadSnapshot(name string) (*crawlSnapshot, error) {
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap crawlSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// saveSnapshot writes snap to name atomically, so a crash mid-write keeps the previous one
+func saveSnapshot(name string, snap crawlSnapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(name, data)
+}
+
+// writeFileAtomic writes data to a temporary file beside name and renames it into place
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// resume restores the crawl state saved in snap; its JS goes to the sink like newly found JS
+func (c *Crawler) resume(snap *crawlSnapshot) {
+	if snap.Host != "" {
+		c.host, c.scheme = snap.Host, snap.Scheme
+	}
+	for _, u := range snap.Seen {
+		c.seen.Add(u)
+	}
+	for js, ref := range snap.JS {
+		c.addJS(js, ref)
+	}
+	for page, d := range snap.Depth {
+		c.depth[page] = d
+	}
+}
+
+// startSnapshots saves state to name every SnapshotInterval until stop is called.
+// state is read under stateMu, which crawl holds except between pages.
+func (c *Crawler) startSnapshots(name string, state func() crawlSnapshot) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(c.SnapshotInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			c.stateMu.RLock()
+			data, err := json.Marshal(state())
+			c.stateMu.RUnlock()
+			if err == nil {
+				err = writeFileAtomic(name, data)
+			}
+			if err != nil {
+				c.logError("Save %s: %v", name, err)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// maxJSRoutes caps the pages -routes-from-js may add to a crawl, since bundles
+// can hold thousands of path-like strings
+const maxJSRoutes = 1000
+
+// jsRouteLiteral matches a quoted absolute path like "/dashboard" or '/users/list'.
+// Template params (":id", "{id}", "*") and other odd characters don't match.
+var jsRouteLiteral = regexp.MustCompile("[\"'`](/[A-Za-z][A-Za-z0-9_~./-]*)[\"'`]")
+
+// jsRoutes downloads a 2xx JS file and returns the route-like paths in it as URLs on the
+// crawl host. Paths with a file extension other than .html/.htm are taken to be assets.
+func (c *Crawler) jsRoutes(ctx context.Context, js string) []string {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, js, nil)
+	if err != nil || !c.takeRequest() {
+		return nil
+	}
+	resp, err := c.do(c.client, req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil
+	}
+	body, err := c.readJS(resp)
+	if err != nil || body == nil {
+		return nil
+	}
+	var out []string
+	for _, m := range jsRouteLiteral.FindAllStringSubmatch(string(body), -1) {
+		route := m[1]
+		if !routeLike(route) {
+			continue
+		}
+		out = append(out, c.normalizeURL(fmt.Sprintf("%s://%s%s", c.scheme, c.host, route)))
+	}
+	return out
+}
+
+// routeLike reports whether a path could be a page: no file extension, or .html/.htm.
+// Anything else is taken to be an asset.
+func routeLike(p string) bool {
+	ext := path.Ext(p)
+	return ext == "" || ext == ".html" || ext == ".htm"
+}
+
+// jsonBlockURLs returns the URL-like string values (absolute, protocol-relative or
+// root-relative) found in the page's JSON script blocks, resolved against base.
+// Blocks that aren't valid JSON are skipped.
+func jsonBlockURLs(ctx context.Context, doc *html.Node, base string) []string {
+	var out []string
+	var collect func(v any)
+	collect = func(v any) {
+		switch v := v.(type) {
+		case string:
+			if strings.HasPrefix(v, "/") || strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://") {
+				if u := resolveURL(base, v); u != "" {
+					out = append(out, u)
+				}
+			}
+		case []any:
+			for _, item := range v {
+				collect(item)
+			}
+		case map[string]any:
+			for _, item := range v {
+				collect(item)
+			}
+		}
+	}
+	walk(ctx, doc, func(n *html.Node) {
+		if n.Type != html.ElementNode || n.Data != "script" || n.FirstChild == nil {
+			return
+		}
+		if typ := strings.ToLower(attr(n, "type")); !strings.Contains(typ, "json") {
+			return
+		}
+		var v any
+		if err := json.Unmarshal([]byte(n.FirstChild.Data), &v); err != nil {
+			logf(levelDebug, "Skipping invalid JSON block on %s: %v", base, err)
+			return
+		}
+		collect(v)
+	})
+	sort.Strings(out) // map order is random; keep the crawl deterministic
+	return out
+}
+
+// cssJSRef matches url(...), @import "..." and Worker/register("...") references in a stylesheet
+var cssJSRef = regexp.MustCompile(`(?i)(?:url\(\s*|@import\s+|(?:Worker|register)\(\s*)["']?([^"')\s;]+)`)
+
+// scanCSS fetches a stylesheet and records the JS URLs it references, resolved
+// against the stylesheet URL and attributed to it
+func (c *Crawler) scanCSS(ctx context.Context, sheet string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sheet, nil)
+	if err != nil || !c.takeRequest() {
+		return
+	}
+	resp, err := c.do(c.client, req)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.logURLError("Fetch CSS", sheet, 0, err)
+		}
+		return
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		c.logURLError("Read CSS", sheet, 0, err)
+		return
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logURL(levelFlag, "CSS", sheet, resp.StatusCode, nil)
+		return
+	}
+	for _, m := range cssJSRef.FindAllStringSubmatch(string(body), -1) {
+		if js := resolveURL(sheet, m[1]); hasJSExt(js, c.JSExts) {
+			c.addJS(js, sheet)
+		}
+	}
+}
+
+// defaultFormSkip matches forms -crawl-forms shouldn't submit because they change
+// account state
+var defaultFormSkip = regexp.MustCompile(`(?i)log[-_ ]?out|sign[-_ ]?out|delete|remove|destroy|unsubscribe|cancel|deactivate`)
+
+// submitForm posts f and collects JS from the page it returns, returning the in-scope
+// links on that page to queue. Forms out of scope or matching FormSkip aren't sent.
+func (c *Crawler) submitForm(ctx context.Context, page string, f postForm) []string {
+	skip := c.FormSkip
+	if skip == nil {
+		skip = defaultFormSkip
+	}
+	if !c.inScope(f.action) {
+		c.explain(f.action, "form action out of scope")
+		return nil
+	}
+	if skip.MatchString(f.action) || skip.MatchString(f.label) {
+		logURL(levelDebug, "Not submitting form matching -form-skip", f.action, 0, nil)
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.action, strings.NewReader(f.values.Encode()))
+	if err != nil || !c.takeRequest() {
+		return nil
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Referer", page)
+	logURL(levelDebug, "Submitting form", f.action, 0, nil)
+	resp, err := c.do(c.client, req)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.logURLError("Submit form", f.action, 0, err)
+		}
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		c.logURLError("Read form response", f.action, 0, err)
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logURL(levelFlag, "Form", f.action, resp.StatusCode, nil)
+		return nil
+	}
+	base := resp.Request.URL.String()
+	doc, err := html.Parse(strings.NewReader(decodeBody(body, resp.Header.Get("Content-Type"))))
+	if err != nil {
+		c.logURLError("Parse HTML", base, 0, err)
+		return nil
+	}
+	docBase := base
+	if href := baseHref(ctx, doc); href != "" && !c.IgnoreBase {
+		if b := resolveURL(base, href); b != "" {
+			docBase = b
+		}
+	}
+	for _, js := range extractJS(ctx, doc, docBase, c.JSExts, c.Extractors) {
+		c.addJS(js, f.action)
+	}
+	var links []string
+	for _, link := range extractLinks(ctx, doc, docBase, c.Links) {
+		if link = c.normalizeURL(link); c.shouldQueue(page, link) {
+			c.seen.Add(link)
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// retryWithSlash refetches a page that 404'd with a trailing slash appended, returning
+// the new response if it isn't also a 404 and the original response otherwise
+func (c *Crawler) retryWithSlash(ctx context.Context, page string, resp *http.Response) *http.Response {
+	u, err := url.Parse(page)
+	if err != nil || strings.HasSuffix(u.Path, "/") {
+		return resp
+	}
+	u.Path += "/"
+	alt := u.String()
+	if c.seen.Has(alt) {
+		return resp
+	}
+	req, err := c.newPageRequest(ctx, alt)
+	if err != nil || !c.takeRequest() {
+		return resp
+	}
+	// Buffer the 404 so its host slot is free for the retry under -per-host-concurrency
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	retry, err := c.do(c.client, req)
+	if err != nil {
+		return resp
+	}
+	if retry.StatusCode == http.StatusNotFound {
+		retry.Body.Close()
+		return resp
+	}
+	resp.Body.Close()
+	logf(levelDebug, "Recovered %s as %s (%d)", page, alt, retry.StatusCode)
+	c.seen.Add(alt)
+	return retry
+}
+
+// countFetch tracks the run of failed fetches for -max-errors: status 0 (a network
+// error), 403, 429 and 5xx extend it, other error statuses like 404 leave it alone, and
+// anything else resets it. Reaching MaxErrors cancels the run's context.
+func (c *Crawler) countFetch(status int) {
+	if c.MaxErrors <= 0 {
+		return
+	}
+	switch {
+	case status == 0 || status == http.StatusForbidden || status == http.StatusTooManyRequests || status >= 500:
+		c.errStreak++
+	case status >= 400:
+		return
+	default:
+		c.errStreak = 0
+		return
+	}
+	if c.errStreak == c.MaxErrors {
+		logf(levelFlag, "Aborting after %d consecutive failed fetches; the target may be blocking us. Writing what was gathered", c.errStreak)
+		c.trip()
+	}
+}
+
+// browserUA is the User-Agent -auto-ua switches to when the root looks blocked
+const browserUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+
+// blockedStatus reports whether status is the kind WAFs and bot filters answer with
+func blockedStatus(status int) bool {
+	return status == http.StatusForbidden || status == http.StatusServiceUnavailable
+}
+
+// retryAsBrowser refetches the blocked root with browserUA. If that gets through,
+// the UA is kept for every later request and the new response returned; otherwise
+// resp is returned unchanged.
+func (c *Crawler) retryAsBrowser(ctx context.Context, page string, resp *http.Response) *http.Response {
+	req, err := c.newPageRequest(ctx, page)
+	if err != nil || !c.takeRequest() {
+		return resp
+	}
+	req.Header.Set("User-Agent", browserUA)
+	// Buffer the blocked response so its host slot is free for the retry
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	retry, err := c.do(c.client, req)
+	if err != nil {
+		return resp
+	}
+	if blockedStatus(retry.StatusCode) {
+		retry.Body.Close()
+		logf(levelDebug, "Root still returned %d with a browser User-Agent", retry.StatusCode)
+		return resp
+	}
+	logf(levelDebug, "Root returned %d but %d with a browser User-Agent; using it for the rest of the run", resp.StatusCode, retry.StatusCode)
+	c.userAgent = browserUA
+	return retry
+}
+
+// emptyHint suggests what to try after a run that found no JS
+func (c *Crawler) emptyHint() {
+	switch {
+	case blockedStatus(c.rootStat) && c.userAgent == "" && !c.AutoUA:
+		logf(levelFlag, "The root returned %d, which usually means a WAF or bot filter blocked the crawler; try -auto-ua for a browser User-Agent, or -proxy-file", c.rootStat)
+	case blockedStatus(c.rootStat):
+		logf(levelFlag, "The root returned %d even with a browser User-Agent; the crawler looks blocked, try -proxy-file", c.rootStat)
+	case c.fetched == 0:
+		logf(levelFlag, "No page could be fetched; check the domain and scheme, or try -auto-ua or -proxy-file if requests are being blocked")
+	default:
+		logf(levelFlag, "%d pages were fetched but none referenced JS; the site may render its pages with JavaScript, which this crawler doesn't run", c.fetched)
+	}
+}
+
+// testJS fetches each discovered JS URL and classifies it into the good and bad files
+func (c *Crawler) testJS(ctx context.Context) error {
+	var toTest []string
+	var already int
+	for js := range c.jsSet {
+		switch {
+		case c.tested0[js]:
+			already++
+		case c.testable(js):
+			toTest = append(toTest, js)
+		}
+	}
+	if already > 0 {
+		logf(levelDebug, "Skipping %d JS files already tested in a prior run; they're left out of the summary and reports (-retest-all tests them again)", already)
+	}
+	if skipped := len(c.jsSet) - len(toTest) - already; skipped > 0 {
+		logf(levelDebug, "Skipping %d JS files on hosts outside -test-hosts", skipped)
+	}
+	if c.PrefetchDNS {
+		prefetchDNS(ctx, toTest)
+	}
+	logf(levelDebug, "Testing JS files...")
+	c.tested = 0
+
+	// Workers do the requests; results are recorded here, one at a time
+	jobs := make(chan string)
+	fetches := make(chan jsFetch)
+	go func() {
+		defer close(jobs)
+		for _, js := range toTest {
+			if ctx.Err() != nil || !c.takeRequest() {
+				return
+			}
+			select {
+			case jobs <- js:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < max(1, c.Concurrency); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for js := range jobs {
+				fetches <- c.fetchJS(ctx, js)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(fetches)
+	}()
+
+	for f := range fetches {
+		c.recordJS(ctx, f)
+	}
+	if left := len(toTest) - c.tested; left > 0 && (ctx.Err() != nil || c.budgetHit.Load()) {
+		logf(levelDebug, "%d JS files left untested", left)
+	}
+	return nil
+}
+
+// jsFetch is the outcome of one JS test request
+type jsFetch struct {
+	js      string
+	status  int
+	good    bool
+	ctype   string // Content-Type of the response
+	tls     *tls.ConnectionState
+	host    string
+	body    []byte // read only when a baseline or SRI check needs it; nil if over MaxJSSize
+	readErr error
+	took    time.Duration
+	err     error
+	badReq  bool // the request couldn't even be built
+}
+
+// jsGood reports whether status counts as a working JS file
+func (c *Crawler) jsGood(status int) bool {
+	if c.StrictJS {
+		return status >= 200 && status <= 299
+	}
+	return status < 400
+}
+
+// fetchJS requests js and reads its body if a check needs it. It runs on the test
+// workers, so it must not touch the Crawler's result state.
+func (c *Crawler) fetchJS(ctx context.Context, js string) jsFetch {
+	f := jsFetch{js: js}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, js, nil)
+	if err != nil {
+		f.err, f.badReq = err, true
+		return f
+	}
+	if ref := c.jsSet[js]; c.SendReferer && ref != "" {
+		req.Header.Set("Referer", ref)
+	}
+	reqStart := time.Now()
+	resp, err := c.do(c.jsClient, req)
+	f.took = time.Since(reqStart)
+	if err != nil {
+		f.err = err
+		return f
+	}
+	defer resp.Body.Close()
+	f.status, f.good = resp.StatusCode, c.jsGood(resp.StatusCode)
+	f.tls, f.host = resp.TLS, resp.Request.URL.Host
+	f.ctype = resp.Header.Get("Content-Type")
+	if (c.Baseline != "" || c.integrity[js] != "" || c.ValidateJS) && f.good {
+		f.body, f.readErr = c.readJS(resp)
+	}
+	return f
+}
+
+// recordJS logs a test result and records it in the sink, results and checks
+func (c *Crawler) recordJS(ctx context.Context, f jsFetch) {
+	js, took := f.js, f.took
+	if f.badReq {
+		c.logURLError("Request JS", js, 0, f.err)
+		c.sink.WriteBad(js, 0, f.err)
+		return
+	}
+	if f.err != nil && ctx.Err() != nil {
+		return // cut off by cancellation rather than a real failure
+	}
+	defer c.countFetch(f.status) // after the result is logged
+	c.tested++
+	if v := screen.Load(); v != nil {
+		v.testing(c.tested, len(c.jsSet))
+	}
+	c.durations[js] = took
+	if f.err != nil {
+		c.logURLError("Fetch JS", js, 0, f.err)
+		if c.statusWanted(0) {
+			c.sink.WriteBad(js, 0, f.err)
+			c.results = append(c.results, jsResult{URL: js, Err: f.err.Error(), Duration: took})
+		}
+		if c.OnJSTested != nil {
+			c.OnJSTested(js, 0, f.err)
+		}
+		return
+	}
+	status, good := f.status, f.good
+	sri := c.integrity[js]
+	if (c.Baseline != "" || sri != "" || c.ValidateJS) && good {
+		if f.readErr != nil {
+			c.logURLError("Read JS", js, 0, f.readErr)
+		} else if f.body == nil {
+			logf(levelFlag, "Skipped body of %s: larger than -max-js-size of %d bytes", js, c.MaxJSSize)
+		} else {
+			if c.Baseline != "" {
+				sum := sha256.Sum256(f.body)
+				c.hashes[js] = hex.EncodeToString(sum[:])
+			}
+			if sri != "" && !sriMatches(sri, f.body) {
+				logURL(levelFlag, "SRI mismatch", js, 0, nil)
+				c.sriBad = append(c.sriBad, js+"\t"+sri)
+			}
+			if c.ValidateJS {
+				if reason := notJS(f.body, f.ctype); reason != "" {
+					logf(levelFlag, "Suspect JS %s: %s", js, reason)
+					c.suspect = append(c.suspect, js+"\t"+reason)
+					good = false
+				}
+			}
+		}
+	}
+	c.recordTLS(f.host, f.tls)
+	if !c.statusWanted(status) {
+		// Filtered out by -only-status
+	} else if good != f.good {
+		// Suspect under -validate-js; listed in its own file, neither good nor bad
+		c.results = append(c.results, jsResult{URL: js, Status: status, Suspect: true, Duration: took})
+	} else if !good {
+		logURL(levelFlag, "JS tested", js, status, nil)
+		c.sink.WriteBad(js, status, nil)
+		c.results = append(c.results, jsResult{URL: js, Status: status, Duration: took})
+	} else {
+		logURL(levelOK, "JS tested", js, status, nil)
+		c.sink.WriteGood(js, status)
+		c.results = append(c.results, jsResult{URL: js, Status: status, OK: true, Duration: took})
+	}
+	if c.OnJSTested != nil {
+		c.OnJSTested(js, status, nil)
+	}
+}
+
+// prefetchLookups caps how many DNS lookups -prefetch-dns runs at once
+const prefetchLookups = 16
+
+// prefetchDNS looks up each distinct host of urls concurrently, logging failures. The
+// results aren't kept; the point is that the system resolver has them cached when the
+// test requests go out. IP literals are skipped.
+func prefetchDNS(ctx context.Context, urls []string) {
+	hosts := map[string]bool{}
+	for _, u := range urls {
+		if pu, err := url.Parse(u); err == nil && pu.Hostname() != "" && net.ParseIP(pu.Hostname()) == nil {
+			hosts[pu.Hostname()] = true
+		}
+	}
+	if len(hosts) == 0 {
+		return
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	var failed atomic.Int64
+	sem := make(chan struct{}, prefetchLookups)
+	for host := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(host string) {
+			defer func() { <-sem; wg.Done() }()
+			if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil && ctx.Err() == nil {
+				failed.Add(1)
+				logf(levelFlag, "DNS lookup for %s failed: %v", host, err)
+			}
+		}(host)
+	}
+	wg.Wait()
+	logf(levelDebug, "Prefetched DNS for %d hosts in %s (%d failed)", len(hosts), time.Since(start).Round(time.Millisecond), failed.Load())
+}
+
+// testable reports whether js is on the crawl host or one of the -test-hosts; all JS is testable when none are set
+func (c *Crawler) testable(js string) bool {
+	if len(c.TestHosts) == 0 || sameDomain(js, c.host) {
+		return true
+	}
+	u, err := url.Parse(js)
+	if err != nil {
+		return false
+	}
+	for _, h := range c.TestHosts {
+		if strings.EqualFold(u.Hostname(), h) {
+			return true
+		}
+	}
+	return false
+}
+
+// readJS reads a JS response body, returning nil without an error when it is
+// larger than MaxJSSize; at most MaxJSSize+1 bytes are read
+func (c *Crawler) readJS(resp *http.Response) ([]byte, error) {
+	if c.MaxJSSize <= 0 {
+		return io.ReadAll(resp.Body)
+	}
+	if resp.ContentLength > c.MaxJSSize {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, c.MaxJSSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > c.MaxJSSize {
+		return nil, nil
+	}
+	return body, nil
+}
+
+// statusWanted reports whether results with status pass the -only-status filter
+func (c *Crawler) statusWanted(status int) bool {
+	if len(c.OnlyStatus) == 0 {
+		return true
+	}
+	for _, code := range c.OnlyStatus {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+// jsResult is the outcome of testing one JS URL
+type jsResult struct {
+	URL      string
+	Status   int           // 0 when the fetch failed
+	Err      string        // fetch error, if any
+	OK       bool          // counted as good
+	Suspect  bool          // good status but not JavaScript, under ValidateJS; neither good nor bad
+	Duration time.Duration // time to the response headers, or to the failure
+}
+
+// reportSlowest logs the n JS URLs with the longest response times
+func (c *Crawler) reportSlowest(n int) {
+	urls := make([]string, 0, len(c.durations))
+	for js := range c.durations {
+		urls = append(urls, js)
+	}
+	sort.Slice(urls, func(i, j int) bool { return c.durations[urls[i]] > c.durations[urls[j]] })
+	if len(urls) > n {
+		urls = urls[:n]
+	}
+	logf(levelDebug, "Slowest %d JS files:", len(urls))
+	for _, js := range urls {
+		logf(levelDebug, "  %8s  %s", c.durations[js].Round(time.Millisecond), js)
+	}
+}
+
+// reportTemplate renders the -format html report: summary stats and a table
+// that sorts by any column when its header is clicked
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>JS report for {{.Domain}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+th { cursor: pointer; background: #eee; }
+tr.good td { background: #e6ffed; }
+tr.bad td { background: #ffeef0; }
+tr.suspect td { background: #fffbdd; }
+</style>
+</head>
+<body>
+<h1>JS report for {{.Domain}}</h1>
+<p>Pages visited: {{.Pages}} &middot; JS found: {{.Found}} &middot; Tested: {{.Tested}} &middot;
+Good: {{.Good}} &middot; Bad: {{.Bad}} &middot;{{if .Suspect}} Suspect: {{.Suspect}} &middot;{{end}} Completed in {{.Duration}}</p>
+<table id="results">
+<thead><tr><th>URL</th><th>Status</th><th>OK</th><th>Time (ms)</th></tr></thead>
+<tbody>
+{{- range .Results}}
+<tr class="{{if .Suspect}}suspect{{else if .OK}}good{{else}}bad{{end}}"><td>{{.URL}}</td><td>{{if .Err}}{{.Err}}{{else}}{{.Status}}{{end}}</td><td>{{if .Suspect}}suspect{{else if .OK}}yes{{else}}no{{end}}</td><td>{{.Duration.Milliseconds}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+<script>
+document.querySelectorAll("#results th").forEach(function (th, col) {
+  th.addEventListener("click", function () {
+    var tbody = document.querySelector("#results tbody");
+    var asc = th.dataset.asc !== "true";
+    th.dataset.asc = asc;
+    Array.from(tbody.rows).sort(function (a, b) {
+      var x = a.cells[col].textContent, y = b.cells[col].textContent;
+      var r = isNaN(x - y) ? x.localeCompare(y) : x - y;
+      return asc ? r : -r;
+    }).forEach(function (row) { tbody.appendChild(row); });
+  });
+});
+</script>
+</body>
+</html>
+`))
+
+// writeHTMLReport renders the test results to <domain>_report.html
+func (c *Crawler) writeHTMLReport(elapsed time.Duration) error {
+	reportFile := fmt.Sprintf("%s_report.html", c.Domain)
+	results := append([]jsResult(nil), c.results...)
+	sort.Slice(results, func(i, j int) bool { return results[i].URL < results[j].URL })
+	good, bad, suspect := c.goodBad()
+
+	var buf bytes.Buffer
+	err := reportTemplate.Execute(&buf, map[string]any{
+		"Domain":   c.Domain,
+		"Pages":    c.seen.Len(),
+		"Found":    len(c.jsSet),
+		"Tested":   len(results),
+		"Good":     good,
+		"Bad":      bad,
+		"Suspect":  suspect,
+		"Duration": elapsed.Round(time.Millisecond),
+		"Results":  results,
+	})
+	if err == nil {
+		err = c.writeFile(reportFile, buf.Bytes())
+	}
+	if err != nil {
+		return fmt.Errorf("write %s: %w", reportFile, err)
+	}
+	logf(levelDebug, "HTML report in %s", reportFile)
+	return nil
+}
+
+// jsonReportVersion is bumped whenever the -format json layout changes incompatibly
+const jsonReportVersion = 1
+
+// jsonReport is the -format json envelope
+type jsonReport struct {
+	Version int          `json:"version"`
+	Domain  string       `json:"domain"`
+	Results []jsonResult `json:"results"`
+	Summary jsonSummary  `json:"summary"`
+}
+
+type jsonResult struct {
+	URL        string `json:"url"`
+	Status     int    `json:"status"` // 0 when the fetch failed
+	Error      string `json:"error,omitempty"`
+	OK         bool   `json:"ok"`
+	Suspect    bool   `json:"suspect,omitempty"` // good status but not JavaScript, under -validate-js
+	DurationMS int64  `json:"duration_ms"`
+}
+
+type jsonSummary struct {
+	PagesVisited int     `json:"pages_visited"`
+	JSFound      int     `json:"js_found"`
+	Good         int     `json:"good"`
+	Bad          int     `json:"bad"`
+	Suspect      int     `json:"suspect,omitempty"`
+	Seconds      float64 `json:"seconds"`
+}
+
+// writeJSONReport writes the test results to <domain>_results.json
+func (c *Crawler) writeJSONReport(elapsed time.Duration) error {
+	reportFile := fmt.Sprintf("%s_results.json", c.Domain)
+	report := jsonReport{
+		Version: jsonReportVersion,
+		Domain:  c.Domain,
+		Results: []jsonResult{},
+		Summary: jsonSummary{PagesVisited: c.seen.Len(), JSFound: len(c.jsSet), Seconds: elapsed.Seconds()},
+	}
+	results := append([]jsResult(nil), c.results...)
+	sort.Slice(results, func(i, j int) bool { return results[i].URL < results[j].URL })
+	for _, r := range results {
+		report.Results = append(report.Results, jsonResult{
+			URL: r.URL, Status: r.Status, Error: r.Err, OK: r.OK, Suspect: r.Suspect, DurationMS: r.Duration.Milliseconds(),
+		})
+	}
+	report.Summary.Good, report.Summary.Bad, report.Summary.Suspect = c.goodBad()
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := c.writeFile(reportFile, append(data, '\n')); err != nil {
+		return fmt.Errorf("write %s: %w", reportFile, err)
+	}
+	logf(levelDebug, "JSON results in %s", reportFile)
+	return nil
+}
+
+// writeChanges compares this run's hashes with the baseline, writing changed or new
+// JS to <domain>_changed_js.txt and a fresh manifest to <domain>_js_manifest.txt
+func (c *Crawler) writeChanges() error {
+	changedFile := c.outputName(fmt.Sprintf("%s_changed_js.txt", c.Domain))
+	manifestFile := fmt.Sprintf("%s_js_manifest.txt", c.Domain)
+
+	urls := make([]string, 0, len(c.hashes))
+	for js := range c.hashes {
+		urls = append(urls, js)
+	}
+	sort.Strings(urls)
+
+	cw, closeChanged, err := c.createOutput(changedFile, true)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", changedFile, err)
+	}
+	defer closeChanged()
+	changed := 0
+	for _, js := range urls {
+		old, ok := c.baseline[js]
+		switch {
+		case !ok:
+			logURL(levelFlag, "New JS", js, 0, nil)
+			fmt.Fprintf(cw, "%s\tnew\n", js)
+		case old != c.hashes[js]:
+			logURL(levelFlag, "Changed JS", js, 0, nil)
+			fmt.Fprintf(cw, "%s\tchanged\n", js)
+		default:
+			continue
+		}
+		changed++
+	}
+	cw.Flush()
+
+	// The manifest always replaces the previous one so it can seed the next run
+	var manifest bytes.Buffer
+	for _, js := range urls {
+		fmt.Fprintf(&manifest, "%s  %s\n", c.hashes[js], js)
+	}
+	if err := c.writeFile(manifestFile, manifest.Bytes()); err != nil {
+		return fmt.Errorf("write %s: %w", manifestFile, err)
+	}
+	logf(levelDebug, "%d changed or new JS in %s, manifest in %s", changed, changedFile, manifestFile)
+	return nil
+}
+
+// notJS returns why body doesn't look like JavaScript, or "" if it does. It's a sniff,
+// not a parse: HTML (by Content-Type or markup) and bodies with no code punctuation at
+// all are flagged; empty bodies pass.
+func notJS(body []byte, ctype string) string {
+	if mt, _, _ := mime.ParseMediaType(ctype); mt == "text/html" || mt == "application/xhtml+xml" {
+		return "served as " + mt
+	}
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")))
+	if len(trimmed) == 0 {
+		return ""
+	}
+	head := strings.ToLower(string(trimmed[:min(len(trimmed), 16)]))
+	for _, p := range []string{"<!doctype", "<html", "<head", "<body", "<?xml"} {
+		if strings.HasPrefix(head, p) {
+			return "body is HTML"
+		}
+	}
+	if !bytes.ContainsAny(trimmed, ";{}()=") {
+		return "no JavaScript tokens"
+	}
+	return ""
+}
+
+// writeSuspectJS writes good-status JS that failed -validate-js to <domain>_suspect_js.txt
+func (c *Crawler) writeSuspectJS() error {
+	suspectFile := c.outputName(fmt.Sprintf("%s_suspect_js.txt", c.Domain))
+	w, closeSuspect, err := c.createOutput(suspectFile, true)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", suspectFile, err)
+	}
+	defer closeSuspect()
+	sort.Strings(c.suspect)
+	for _, line := range c.suspect {
+		fmt.Fprintln(w, line)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write %s: %w", suspectFile, err)
+	}
+	logf(levelDebug, "%d suspect JS in %s", len(c.suspect), suspectFile)
+	return nil
+}
+
+// writeSRIMismatches writes JS whose content failed its integrity hash to <domain>_sri_mismatch.txt
+func (c *Crawler) writeSRIMismatches() error {
+	sriFile := c.outputName(fmt.Sprintf("%s_sri_mismatch.txt", c.Domain))
+	w, closeSRI, err := c.createOutput(sriFile, true)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", sriFile, err)
+	}
+	defer closeSRI()
+	sort.Strings(c.sriBad)
+	for _, line := range c.sriBad {
+		fmt.Fprintln(w, line)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write %s: %w", sriFile, err)
+	}
+	logf(levelDebug, "%d of %d SRI-protected JS mismatched, listed in %s", len(c.sriBad), len(c.integrity), sriFile)
+	return nil
+}
+
+// writeConfigJS lists discovered JS whose file name matches ConfigJS to <domain>_config_js.txt
+func (c *Crawler) writeConfigJS() error {
+	configFile := c.outputName(fmt.Sprintf("%s_config_js.txt", c.Domain))
+	var matches []string
+	for js := range c.jsSet {
+		if u, err := url.Parse(js); err == nil && c.ConfigJS.MatchString(path.Base(u.Path)) {
+			matches = append(matches, js)
+		}
+	}
+	sort.Strings(matches)
+
+	w, closeConfig, err := c.createOutput(configFile, true)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", configFile, err)
+	}
+	defer closeConfig()
+	for _, js := range matches {
+		logURL(levelFlag, "Config JS", js, 0, nil)
+		fmt.Fprintln(w, c.jsLine(js))
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write %s: %w", configFile, err)
+	}
+	logf(levelDebug, "%d config-like JS in %s", len(matches), configFile)
+	return nil
+}
+
+// writeNewJS lists discovered JS missing from the KnownJS list to <domain>_new_js.txt.
+// Both sides are normalized, so fragment or percent-encoding differences don't count as new.
+func (c *Crawler) writeNewJS() error {
+	newFile := c.outputName(fmt.Sprintf("%s_new_js.txt", c.Domain))
+	var fresh []string
+	for js := range c.jsSet {
+		if !c.known[c.normalizeURL(js)] {
+			fresh = append(fresh, js)
+		}
+	}
+	sort.Strings(fresh)
+	c.newJS = len(fresh)
+
+	w, closeNew, err := c.createOutput(newFile, true)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", newFile, err)
+	}
+	defer closeNew()
+	for _, js := range fresh {
+		logURL(levelFlag, "New JS", js, 0, nil)
+		fmt.Fprintln(w, c.jsLine(js))
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write %s: %w", newFile, err)
+	}
+	logf(levelDebug, "%d of %d JS not in %s, listed in %s", len(fresh), len(c.jsSet), c.KnownJS, newFile)
+	return nil
+}
+
+// collapsedName strips the CollapseHash segment from the path of js, so main.a1b2c3d4.js
+// and main.e5f6a7b8.js share the logical name main.js; the query is dropped
+func (c *Crawler) collapsedName(js string) string {
+	u, err := url.Parse(js)
+	if err != nil {
+		return js
+	}
+	repl := ""
+	if c.CollapseHash.NumSubexp() > 0 {
+		repl = "$1"
+	}
+	u.Path = c.CollapseHash.ReplaceAllString(u.Path, repl)
+	u.RawPath, u.RawQuery = "", ""
+	return u.String()
+}
+
+// writeCollapsed writes each logical JS name with how many URLs collapsed into it and
+// how many of those tested good/bad to <domain>_collapsed_js.txt
+func (c *Crawler) writeCollapsed() error {
+	collapsedFile := c.outputName(fmt.Sprintf("%s_collapsed_js.txt", c.Domain))
+	type counts struct{ urls, good, bad int }
+	groups := map[string]*counts{}
+	group := func(js string) *counts {
+		name := c.collapsedName(js)
+		if groups[name] == nil {
+			groups[name] = &counts{}
+		}
+		return groups[name]
+	}
+	for js := range c.jsSet {
+		group(js).urls++
+	}
+	for _, r := range c.results {
+		switch {
+		case r.Suspect:
+			// Listed in the suspect file, not as good or bad
+		case r.OK:
+			group(r.URL).good++
+		default:
+			group(r.URL).bad++
+		}
+	}
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w, closeCollapsed, err := c.createOutput(collapsedFile, true)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", collapsedFile, err)
+	}
+	defer closeCollapsed()
+	for _, name := range names {
+		g := groups[name]
+		fmt.Fprintf(w, "%s\turls=%d\tgood=%d\tbad=%d\n", name, g.urls, g.good, g.bad)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write %s: %w", collapsedFile, err)
+	}
+	logf(levelDebug, "%d JS URLs collapse to %d logical files, listed in %s", len(c.jsSet), len(names), collapsedFile)
+	return nil
+}
+
+// readManifest reads "<sha256>  <url>" lines as written by writeChanges; a missing
+// file is treated as an empty baseline so the first run can bootstrap one
+func readManifest(name string) (map[string]string, error) {
+	hashes := map[string]string{}
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		logf(levelDebug, "Baseline %s not found; every good JS counts as new", name)
+		return hashes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 2 {
+			hashes[fields[1]] = fields[0]
+		}
+	}
+	return hashes, sc.Err()
+}
+
+// saveErrorPage writes the body of a failed page to <domain>_error_pages/<status>_<url>.html
+func (c *Crawler) saveErrorPage(page string, status int, body []byte) {
+	dir := fmt.Sprintf("%s_error_pages", c.Domain)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		c.logError("Create %s: %v", dir, err)
+		return
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%d_%s.html", status, safeFilename(page)))
+	if err := c.writeFile(name, body); err != nil {
+		c.logError("Write %s: %v", name, err)
+	}
+}
+
+// safeFilename turns a URL into a bounded-length name using only [A-Za-z0-9._-]
+func safeFilename(u string) string {
+	u = strings.TrimPrefix(strings.TrimPrefix(u, "https://"), "http://")
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, u)
+	if len(name) > 150 {
+		name = name[:150]
+	}
+	return name
+}
+
+// logProto logs the HTTP protocol a host answered with, once per host
+func (c *Crawler) logProto(resp *http.Response) {
+	host := resp.Request.URL.Host
+	c.protoMu.Lock()
+	_, ok := c.protos[host]
+	c.protos[host] = resp.Proto
+	c.protoMu.Unlock()
+	if ok {
+		return
+	}
+	logf(levelDebug, "%s negotiated %s", host, resp.Proto)
+}
+
+// recordTLS notes the negotiated TLS parameters the first time host is seen
+func (c *Crawler) recordTLS(host string, state *tls.ConnectionState) {
+	if !c.TLSInfo {
+		return
+	}
+	if _, ok := c.tlsInfo[host]; ok {
+		return
+	}
+	if state == nil {
+		c.tlsInfo[host] = "no TLS (plain http)"
+		return
+	}
+	c.tlsInfo[host] = fmt.Sprintf("%s %s", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+}
+
+// writeTLSInfo writes the recorded TLS parameters, one host per line, to <domain>_tls.txt
+func (c *Crawler) writeTLSInfo() {
+	tlsFile := c.outputName(fmt.Sprintf("%s_tls.txt", c.Domain))
+	w, closeTLS, err := c.createOutput(tlsFile, true)
+	if err != nil {
+		c.logError("Create %s: %v", tlsFile, err)
+		return
+	}
+	defer closeTLS()
+
+	hosts := make([]string, 0, len(c.tlsInfo))
+	for host := range c.tlsInfo {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		fmt.Fprintf(w, "%s\t%s\n", host, c.tlsInfo[host])
+	}
+	w.Flush()
+	logf(levelDebug, "TLS info in %s", tlsFile)
+}
+
+// certReport records the first certificate problem seen for each host during a run
+type certReport struct {
+	mu      sync.Mutex
+	hosts   map[string]string
+	checked map[string]bool // hosts whose accepted certificate was verified by check
+}
+
+func (r *certReport) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts = map[string]string{}
+	r.checked = map[string]bool{}
+}
+
+// check verifies the certificate host presented on an accepted connection, once per
+// host. It only finds problems under -insecure, where the transport skips verification.
+func (r *certReport) check(host string, state *tls.ConnectionState) {
+	r.mu.Lock()
+	if r.checked == nil || r.checked[host] {
+		r.mu.Unlock()
+		return
+	}
+	r.checked[host] = true
+	r.mu.Unlock()
+	if err := verifyPeer(host, state); err != nil {
+		r.record(host, err)
+	}
+}
+
+// record logs a [TLS] line the first time host presents an invalid certificate
+func (r *certReport) record(host string, err error) {
+	r.mu.Lock()
+	if _, ok := r.hosts[host]; ok || r.hosts == nil {
+		r.mu.Unlock()
+		return
+	}
+	r.hosts[host] = err.Error()
+	r.mu.Unlock()
+	logf(levelTLS, "Invalid certificate for %s: %v", host, err)
+}
+
+// certError returns the certificate verification failure behind err, or nil if err
+// is some other kind of failure
+func certError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var unknown x509.UnknownAuthorityError
+	switch {
+	case errors.As(err, &invalid):
+		return invalid
+	case errors.As(err, &hostname):
+		return hostname
+	case errors.As(err, &unknown):
+		return unknown
+	}
+	return nil
+}
+
+// verifyPeer checks the chain and name host presented as the default TLS config would
+func verifyPeer(host string, cs *tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no certificate presented")
+	}
+	opts := x509.VerifyOptions{DNSName: host, Intermediates: x509.NewCertPool()}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// writeCertProblems writes each host with an invalid certificate and why, to
+// <domain>_tls_errors.txt; nothing is written when every certificate was valid
+func (c *Crawler) writeCertProblems() {
+	c.certs.mu.Lock()
+	problems := c.certs.hosts
+	c.certs.hosts = nil
+	c.certs.mu.Unlock()
+	if len(problems) == 0 {
+		return
+	}
+	errFile := c.outputName(fmt.Sprintf("%s_tls_errors.txt", c.Domain))
+	w, closeErrs, err := c.createOutput(errFile, true)
+	if err != nil {
+		c.logError("Create %s: %v", errFile, err)
+		return
+	}
+	defer closeErrs()
+
+	hosts := make([]string, 0, len(problems))
+	for host := range problems {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		fmt.Fprintf(w, "%s\t%s\n", host, problems[host])
+	}
+	w.Flush()
+	logf(levelDebug, "%d host(s) with invalid certificates in %s", len(hosts), errFile)
+}
+
+// ResultSink receives results as they are produced: each JS URL when first found,
+// then each tested URL as good or bad. status is 0 when err is set.
+type ResultSink interface {
+	WriteAll(url string)
+	WriteGood(url string, status int)
+	WriteBad(url string, status int, err error)
+	Close() error
+}
+
+// discardSink is a ResultSink that drops everything, used by -count-only
+type discardSink struct{}
+
+func (discardSink) WriteAll(string)             {}
+func (discardSink) WriteGood(string, int)       {}
+func (discardSink) WriteBad(string, int, error) {}
+func (discardSink) Close() error                { return nil }
+
+// fileSink is the default ResultSink, writing <domain>_all_js.txt, <domain>_good_js.txt
+// and <domain>_bad_js.txt as results arrive so a crash keeps what was found
+type fileSink struct {
+	c                  *Crawler
+	all, good, bad     *lineWriter
+	internal, external *lineWriter         // -external-js split of the all-JS file
+	byStatus           map[int]*lineWriter // -split-by-status files, opened as statuses turn up
+	grouped            map[string]string   // all-JS held back until Close under -group-by-host
+	names              []string            // created files, logged on Close
+	closers            []func()
+}
+
+// newFileSink creates the output files for c, honoring -no-all/-no-good/-no-bad and -append
+func newFileSink(c *Crawler) (*fileSink, error) {
+	s := &fileSink{c: c}
+	if c.GroupByHost {
+		s.grouped = map[string]string{}
+	}
+	for _, out := range []struct {
+		w       **lineWriter
+		kind    string
+		enabled bool
+	}{
+		{&s.all, "all", !c.NoAll}, {&s.good, "good", !c.NoGood}, {&s.bad, "bad", !c.NoBad},
+		{&s.internal, "internal", c.ExternalJS}, {&s.external, "external", c.ExternalJS},
+	} {
+		name := c.outputName(fmt.Sprintf("%s_%s_js.txt", c.Domain, out.kind))
+		w, closeFn, err := c.createOutput(name, out.enabled)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("create %s: %w", name, err)
+		}
+		s.closers = append(s.closers, closeFn)
+		if out.enabled {
+			s.names = append(s.names, name)
+		}
+		*out.w = newLineWriter(w)
+	}
+	return s, nil
+}
+
+func (s *fileSink) WriteAll(url string) {
+	if sameDomain(url, s.c.host) {
+		s.internal.WriteLine(s.c.jsLine(url))
+	} else {
+		s.external.WriteLine(s.c.jsLine(url))
+	}
+	if s.grouped != nil {
+		s.grouped[url] = ""
+		return
+	}
+	s.all.WriteLine(s.c.jsLine(url))
+}
+
+func (s *fileSink) WriteGood(url string, status int) {
+	s.good.WriteLine(s.c.jsLine(url))
+	s.writeStatus(url, status)
+}
+
+func (s *fileSink) WriteBad(url string, status int, err error) {
+	line := s.c.jsLine(url)
+	if s.c.StrictJS && status != 0 {
+		// Redirects are bad here too, so note the status to tell them from 404s
+		line = url + "\t" + strconv.Itoa(status) + strings.TrimPrefix(line, url)
+	}
+	s.bad.WriteLine(line)
+	s.writeStatus(url, status)
+}
+
+// writeStatus adds url to its -split-by-status file, opening the file on first use
+func (s *fileSink) writeStatus(url string, status int) {
+	if !s.c.SplitByStatus {
+		return
+	}
+	lw, ok := s.byStatus[status]
+	if !ok {
+		suffix := strconv.Itoa(status)
+		if status == 0 {
+			suffix = "error"
+		}
+		name := s.c.outputName(fmt.Sprintf("%s_js_%s.txt", s.c.Domain, suffix))
+		w, closeFn, err := s.c.createOutput(name, true)
+		if err != nil {
+			s.c.logError("Create %s: %v", name, err)
+			w, closeFn = bufio.NewWriter(io.Discard), func() {}
+		} else {
+			s.names = append(s.names, name)
+		}
+		s.closers = append(s.closers, closeFn)
+		lw = newLineWriter(w)
+		if s.byStatus == nil {
+			s.byStatus = map[int]*lineWriter{}
+		}
+		s.byStatus[status] = lw
+	}
+	lw.WriteLine(s.c.jsLine(url))
+}
+
+// Close writes any grouped all-JS, then flushes and closes the files
+func (s *fileSink) Close() error {
+	var err error
+	if len(s.grouped) > 0 && s.all != nil {
+		s.all.mu.Lock()
+		s.c.writeGroupedByHost(s.all.w, s.grouped)
+		s.all.mu.Unlock()
+	}
+	writers := []*lineWriter{s.all, s.good, s.bad, s.internal, s.external}
+	for _, lw := range s.byStatus {
+		writers = append(writers, lw)
+	}
+	for _, lw := range writers {
+		if lw != nil {
+			if ferr := lw.Close(); ferr != nil && err == nil {
+				err = ferr
+			}
+		}
+	}
+	for _, closeFn := range s.closers {
+		closeFn()
+	}
+	s.closers = nil
+	for _, name := range s.names {
+		logf(levelDebug, "Wrote %s", name)
+	}
+	s.names = nil
+	return err
+}
+
+// screen is the live -tui view while one is running; logging goes to it instead of stdout
+var screen atomic.Pointer[tuiView]
+
+// tuiView redraws a progress summary in place a few times a second with raw ANSI escapes
+type tuiView struct {
+	mu       sync.Mutex
+	domain   string
+	start    time.Time
+	requests *atomic.Int64
+	errs     *atomic.Int64
+	phase    string
+	queue    int
+	pages    int
+	js       int
+	tested   int
+	recent   []string // last pages crawled
+	lines    []string // last log lines
+	done     chan struct{}
+	finished chan struct{}
+}
+
+// tuiRecent is how many recent pages and log lines the view shows
+const tuiRecent = 8
+
+// newTUIView starts redrawing the view until stop is called
+func newTUIView(domain string, requests, errs *atomic.Int64) *tuiView {
+	v := &tuiView{
+		domain:   domain,
+		start:    time.Now(),
+		requests: requests,
+		errs:     errs,
+		phase:    "crawling",
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go func() {
+		defer close(v.finished)
+		tick := time.NewTicker(250 * time.Millisecond)
+		defer tick.Stop()
+		for {
+			v.draw()
+			select {
+			case <-tick.C:
+			case <-v.done:
+				v.draw()
+				return
+			}
+		}
+	}()
+	return v
+}
+
+// stopTUI stops any running view, leaving its last frame on screen, and restores the line log
+func stopTUI() {
+	if v := screen.Swap(nil); v != nil {
+		close(v.done)
+		<-v.finished
+	}
+}
+
+func (v *tuiView) crawling(page string, queue, pages, js int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.queue, v.pages, v.js = queue, pages, js
+	v.recent = appendRecent(v.recent, page)
+}
+
+func (v *tuiView) testing(tested, js int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.phase, v.tested, v.js, v.queue = "testing JS", tested, js, 0
+}
+
+func (v *tuiView) log(level slog.Level, msg string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.lines = appendRecent(v.lines, fmt.Sprintf("%-6s %s", "["+levelName(level)+"]", msg))
+}
+
+// appendRecent appends s, keeping only the last tuiRecent entries
+func appendRecent(list []string, s string) []string {
+	list = append(list, s)
+	if len(list) > tuiRecent {
+		list = list[len(list)-tuiRecent:]
+	}
+	return list
+}
+
+// draw clears the terminal and prints the current state
+func (v *tuiView) draw() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	requests, errs := v.requests.Load(), v.errs.Load()
+	errRate := 0.0
+	if requests > 0 {
+		errRate = 100 * float64(errs) / float64(requests)
+	}
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&b, "\x1b[1m%s\x1b[0m  %s  %s\n\n", v.domain, v.phase, time.Since(v.start).Round(time.Second))
+	fmt.Fprintf(&b, "Pages: %d  Queue: %d  JS found: %d  Tested: %d/%d  Requests: %d  Errors: %d (%.1f%%)\n\n",
+		v.pages, v.queue, v.js, v.tested, v.js, requests, errs, errRate)
+	b.WriteString("Recent pages:\n")
+	for _, p := range v.recent {
+		fmt.Fprintf(&b, "  %s\n", truncate(p, 120))
+	}
+	b.WriteString("\nRecent log:\n")
+	for _, l := range v.lines {
+		fmt.Fprintf(&b, "  %s\n", truncate(l, 120))
+	}
+	os.Stdout.WriteString(b.String())
+}
+
+// truncate shortens s to at most n bytes, marking the cut with "..."
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
+
+// lineWriter is a mutex-guarded buffered line writer. Until it's closed a ticker
+// flushes it every second, so tail -f keeps up through quiet stretches without a
+// write syscall per line.
+type lineWriter struct {
+	mu   sync.Mutex
+	w    *bufio.Writer
+	stop chan struct{}
+	once sync.Once
+}
+
+// newLineWriter wraps w and starts its once-a-second flush; Close stops it
+func newLineWriter(w *bufio.Writer) *lineWriter {
+	lw := &lineWriter{w: w, stop: make(chan struct{})}
+	go func() {
+		tick := time.NewTicker(time.Second)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				lw.Flush()
+			case <-lw.stop:
+				return
+			}
+		}
+	}()
+	return lw
+}
+
+// WriteLine appends line; it reaches the file by the next tick at the latest
+func (lw *lineWriter) WriteLine(line string) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	fmt.Fprintln(lw.w, line)
+}
+
+// Flush writes any buffered lines
+func (lw *lineWriter) Flush() error {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Flush()
+}
+
+// Close stops the periodic flush and writes any buffered lines. The underlying file
+// is the caller's to close, afterwards.
+func (lw *lineWriter) Close() error {
+	lw.once.Do(func() { close(lw.stop) })
+	return lw.Flush()
+}
+
+// createOutput opens name for buffered writing, truncating it unless -append is set;
+// when disabled nothing is created and writes are discarded
+func (c *Crawler) createOutput(name string, enabled bool) (*bufio.Writer, func(), error) {
+	if !enabled {
+		return bufio.NewWriter(io.Discard), func() {}, nil
+	}
+	if c.AtomicOutput {
+		return c.createAtomic(name)
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if c.Append {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(name, flags, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	out, finish := gzipIfNeeded(name, f)
+	w := bufio.NewWriter(out)
+	return w, func() {
+		w.Flush()
+		finish()
+		f.Close()
+	}, nil
+}
+
+// outputName returns name as it's written to disk: .txt outputs get .gz appended
+// under -compress-output
+func (c *Crawler) outputName(name string) string {
+	if c.CompressOutput && strings.HasSuffix(name, ".txt") {
+		return name + ".gz"
+	}
+	return name
+}
+
+// gzipIfNeeded wraps f in a gzip writer when name ends in .gz. finish must be called
+// after the last write: flushing alone leaves the gzip stream incomplete.
+func gzipIfNeeded(name string, f io.Writer) (out io.Writer, finish func() error) {
+	if !strings.HasSuffix(name, ".gz") {
+		return f, func() error { return nil }
+	}
+	gz := gzip.NewWriter(f)
+	return gz, gz.Close
+}
+
+// createAtomic is createOutput under -atomic-output: it writes to name.tmp, starting
+// from a copy of name under -append, and the closer renames it over name once flushed.
+// If the flush fails name is left as it was.
+func (c *Crawler) createAtomic(name string) (*bufio.Writer, func(), error) {
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.Append {
+		if old, err := os.Open(name); err == nil {
+			_, err = io.Copy(f, old)
+			old.Close()
+			if err != nil {
+				f.Close()
+				os.Remove(tmp)
+				return nil, nil, err
+			}
+		} else if !os.IsNotExist(err) {
+			f.Close()
+			os.Remove(tmp)
+			return nil, nil, err
+		}
+	}
+	out, finish := gzipIfNeeded(name, f)
+	w := bufio.NewWriter(out)
+	return w, func() {
+		err := w.Flush()
+		if err == nil {
+			err = finish()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp, name)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			c.logError("Write %s: %v", name, err)
+		}
+	}, nil
+}
+
+// writeFile writes a whole output file, atomically under -atomic-output
+func (c *Crawler) writeFile(name string, data []byte) error {
+	if c.AtomicOutput {
+		return writeFileAtomic(name, data)
+	}
+	return os.WriteFile(name, data, 0o644)
+}
+
+// readURLList reads a previously written URL file, gunzipping .gz ones, skipping blank
+// lines and "# host" headers and dropping any tab-separated referrer; a missing file
+// yields no URLs
+func readURLList(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	var urls []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		js, _, _ := strings.Cut(line, "\t")
+		urls = append(urls, js)
+	}
+	return urls, sc.Err()
+}
+
+// rate returns n per second over d, or 0 for an empty duration
+func rate(n int, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
+
+// defaultJSExts are the extensions treated as JS when none are configured
+var defaultJSExts = []string{".js", ".mjs"}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// parseResolves turns host:ip entries into a host -> ip map
+func parseResolves(entries []string) (map[string]string, error) {
+	overrides := map[string]string{}
+	for _, e := range entries {
+		host, ip, ok := strings.Cut(e, ":")
+		ip = strings.Trim(ip, "[]")
+		if !ok || host == "" || net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid -resolve %q, want host:ip", e)
+		}
+		overrides[strings.ToLower(host)] = ip
+	}
+	return overrides, nil
+}
+
+// clientConfig holds the transport settings shared by page and JS requests
+type clientConfig struct {
+	resolves map[string]string // host -> pinned IP (-resolve)
+	certs    []tls.Certificate // client certificates presented for mutual TLS
+	jar      http.CookieJar    // cookies sent with every request (-cookie-file)
+	proxies  *proxyPool        // rotated per request (-proxy-file)
+	http2    bool              // force HTTP/2, with h2c for cleartext
+
+	// headerTimeout bounds the wait for response headers after the request is sent;
+	// timeout bounds the whole exchange, body included. A slow-but-alive download of a
+	// large JS file therefore only fails on timeout, while a host that never answers
+	// fails after headerTimeout. Zero disables either limit.
+	headerTimeout time.Duration
+	timeout       time.Duration
+
+	insecure bool // skip certificate verification; failures are still reported via certReport
+}
+
+// newClient returns an HTTP client for cfg. Pinned hosts are redirected at dial time;
+// the request URL is untouched, so the Host header and TLS SNI still carry the original name.
+func newClient(cfg clientConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		target := addr
+		host, port, err := net.SplitHostPort(addr)
+		if err == nil {
+			if ip, ok := cfg.resolves[strings.ToLower(host)]; ok {
+				target = net.JoinHostPort(ip, port)
+			}
+		}
+		conn, err := dialer.DialContext(ctx, network, target)
+		if err != nil && cfg.proxies != nil {
+			cfg.proxies.markDown(addr)
+		}
+		return conn, err
+	}
+	if cfg.proxies != nil {
+		tr.Proxy = cfg.proxies.pick
+	}
+	if len(cfg.certs) > 0 || cfg.insecure {
+		// Under insecure, Crawler.do still verifies what was accepted so problems are reported
+		tr.TLSClientConfig = &tls.Config{Certificates: cfg.certs, InsecureSkipVerify: cfg.insecure}
+	}
+	tr.ResponseHeaderTimeout = cfg.headerTimeout
+	// The HTTP/2 transports have no header timeout, so only cfg.timeout applies there
+	if cfg.http2 {
+		return &http.Client{Transport: newHTTP2Transport(tr), Jar: cfg.jar, Timeout: cfg.timeout}
+	}
+	return &http.Client{Transport: tr, Jar: cfg.jar, Timeout: cfg.timeout}
+}
+
+// newHTTP2Transport returns a transport that speaks only HTTP/2: over TLS for https
+// and h2c with prior knowledge for http. Dials go through tr so -resolve still applies.
+func newHTTP2Transport(tr *http.Transport) http.RoundTripper {
+	h2 := &http2.Transport{
+		TLSClientConfig: tr.TLSClientConfig,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := tr.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, cfg)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+	}
+	h2c := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return tr.DialContext(ctx, network, addr)
+		},
+	}
+	return schemeTransport{"https": h2, "http": h2c}
+}
+
+// schemeTransport routes each request to the transport for its URL scheme
+type schemeTransport map[string]http.RoundTripper
+
+func (t schemeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt, ok := t[req.URL.Scheme]; ok {
+		return rt.RoundTrip(req)
+	}
+	return nil, fmt.Errorf("unsupported protocol scheme %q", req.URL.Scheme)
+}
+
+// proxyDownTime is how long a proxy that couldn't be reached is skipped
+const proxyDownTime = time.Minute
+
+// proxyPool hands out proxies round-robin, skipping ones recently found unreachable
+type proxyPool struct {
+	mu        sync.Mutex
+	proxies   []*url.URL
+	next      int
+	downUntil map[string]time.Time // proxy host:port -> when to try it again
+}
+
+// loadProxies reads proxy URLs, one per line, skipping blanks and # comments
+func loadProxies(name string) (*proxyPool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pool := &proxyPool{downUntil: map[string]time.Time{}}
+	for _, line := range readDomains(f) {
+		u, err := url.Parse(line)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q, want a URL like http://host:port", line)
+		}
+		pool.proxies = append(pool.proxies, u)
+	}
+	if len(pool.proxies) == 0 {
+		return nil, fmt.Errorf("no proxies in %s", name)
 	}
-	root := fmt.Sprintf("%s://%s/", scheme, domain)
+	logf(levelDebug, "Loaded %d proxies from %s", len(pool.proxies), name)
+	return pool, nil
+}
 
-	fmt.Printf("[DEBUG] Starting crawl for %s\n", root)
+// pick is an http.Transport Proxy func returning the next proxy that isn't marked
+// down; if all are down it returns the next one anyway
+func (p *proxyPool) pick(*http.Request) (*url.URL, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for range p.proxies {
+		u := p.proxies[p.next]
+		p.next = (p.next + 1) % len(p.proxies)
+		if now.After(p.downUntil[proxyAddr(u)]) {
+			return u, nil
+		}
+	}
+	u := p.proxies[p.next]
+	p.next = (p.next + 1) % len(p.proxies)
+	return u, nil
+}
 
-	// Crawl
-	seen := map[string]bool{root: true}
-	queue := []string{root}
-	jsSet := map[string]bool{}
+// markDown skips the proxy at addr for proxyDownTime after a failed dial; other addrs are ignored
+func (p *proxyPool) markDown(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, u := range p.proxies {
+		if proxyAddr(u) == addr {
+			logf(levelFlag, "Proxy %s unreachable; skipping it for %s", u.Host, proxyDownTime)
+			p.downUntil[addr] = time.Now().Add(proxyDownTime)
+			return
+		}
+	}
+}
 
-	for len(queue) > 0 {
-		page := queue[0]
-		queue = queue[1:]
-		fmt.Printf("[DEBUG] Crawling page: %s\n", page)
+// proxyAddr returns the host:port dialed for proxy u, filling in the scheme's default port
+func proxyAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	switch u.Scheme {
+	case "https":
+		port = "443"
+	case "socks5", "socks5h":
+		port = "1080"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
 
-		resp, err := http.Get(page)
-		if err != nil {
-			fmt.Printf("[ERROR] Fetch %s: %v\n", page, err)
+// loadCookieFile reads a Netscape cookies.txt into a new jar. Each line is
+// domain, include-subdomains, path, secure, expiry (unix seconds, 0 for session),
+// name and value, tab-separated; a "#HttpOnly_" domain prefix marks HttpOnly cookies.
+// Expired cookies are skipped.
+func loadCookieFile(name string) (http.CookieJar, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimRight(sc.Text(), "\r")
+		httpOnly := strings.HasPrefix(text, "#HttpOnly_")
+		if httpOnly {
+			text = strings.TrimPrefix(text, "#HttpOnly_")
+		} else if text == "" || strings.HasPrefix(text, "#") {
 			continue
 		}
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
+		fields := strings.Split(text, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("%s:%d: want 7 tab-separated fields, got %d", name, line, len(fields))
+		}
+		expiry, err := strconv.ParseInt(fields[4], 10, 64)
 		if err != nil {
-			fmt.Printf("[ERROR] Read %s: %v\n", page, err)
-			continue
+			return nil, fmt.Errorf("%s:%d: invalid expiry %q", name, line, fields[4])
 		}
-		content := string(body)
-
-		// Extract JS URLs
-		for _, js := range extractJS(content, page) {
-			jsSet[js] = true
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
 		}
-		// Extract links
-		for _, link := range extractLinks(content, page) {
-			if sameDomain(link, domain) && !seen[link] {
-				seen[link] = true
-				queue = append(queue, link)
+		if expiry != 0 {
+			cookie.Expires = time.Unix(expiry, 0)
+			if cookie.Expires.Before(time.Now()) {
+				continue
 			}
 		}
+		host := strings.TrimPrefix(fields[0], ".")
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = host // sent to subdomains too; host-only otherwise
+		}
+		scheme := "http"
+		if cookie.Secure {
+			scheme = "https"
+		}
+		jar.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: "/"}, []*http.Cookie{cookie})
+		n++
 	}
-
-	if len(jsSet) == 0 {
-		fmt.Printf("[DEBUG] No JS files found; exiting.\n")
-		return
+	if err := sc.Err(); err != nil {
+		return nil, err
 	}
+	logf(levelDebug, "Loaded %d cookies from %s", n, name)
+	return jar, nil
+}
 
-	// Prepare files
-	allFile := fmt.Sprintf("%s_all_js.txt", domain)
-	goodFile := fmt.Sprintf("%s_good_js.txt", domain)
-	badFile := fmt.Sprintf("%s_bad_js.txt", domain)
-
-	af, err := os.Create(allFile)
+// newPageRequest builds a GET request for a page, setting Accept-Language and
+// If-Modified-Since when configured
+func (c *Crawler) newPageRequest(ctx context.Context, page string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, page, nil)
 	if err != nil {
-		fmt.Printf("[ERROR] Create %s: %v\n", allFile, err)
-		return
+		return nil, err
 	}
-	defer af.Close()
-	gf, err := os.Create(goodFile)
+	if c.AcceptLanguage != "" {
+		req.Header.Set("Accept-Language", c.AcceptLanguage)
+	}
+	if !c.Since.IsZero() {
+		req.Header.Set("If-Modified-Since", c.Since.UTC().Format(http.TimeFormat))
+	}
+	return req, nil
+}
+
+// decodeBody converts a page body to UTF-8 using the Content-Type charset or a
+// <meta charset> declaration, falling back to the raw bytes if detection fails
+func decodeBody(body []byte, contentType string) string {
+	r, err := charset.NewReader(bytes.NewReader(body), contentType)
 	if err != nil {
-		fmt.Printf("[ERROR] Create %s: %v\n", goodFile, err)
-		return
+		return string(body)
 	}
-	defer gf.Close()
-	bf, err := os.Create(badFile)
+	decoded, err := io.ReadAll(r)
 	if err != nil {
-		fmt.Printf("[ERROR] Create %s: %v\n", badFile, err)
-		return
+		return string(body)
 	}
-	defer bf.Close()
+	return string(decoded)
+}
+
+// Extractor finds candidate JS URLs at one node of a parsed page, resolving them
+// against base (the page URL). Extractors are called for every node; results are
+// kept when their path has one of the Crawler's JS extensions.
+type Extractor interface {
+	Extract(node *html.Node, base string) []string
+}
 
-	aw := bufio.NewWriter(af)
-	gw := bufio.NewWriter(gf)
-	bw := bufio.NewWriter(bf)
+// ExtractorFunc adapts a plain function to an Extractor
+type ExtractorFunc func(node *html.Node, base string) []string
 
-	// Write all
-	for js := range jsSet {
-		fmt.Fprintln(aw, js)
-	}
-	aw.Flush()
-	fmt.Printf("[DEBUG] Wrote all JS to %s\n", allFile)
+func (f ExtractorFunc) Extract(node *html.Node, base string) []string { return f(node, base) }
 
-	// Test and classify
-	fmt.Println("[DEBUG] Testing JS files...")
-	for js := range jsSet {
-		resp, err := http.Get(js)
-		if err != nil {
-			fmt.Printf("[ERROR] Fetch JS %s: %v\n", js, err)
-			fmt.Fprintln(bw, js)
-			continue
+// DefaultExtractors returns the built-in extractors used when a Crawler has none configured
+func DefaultExtractors() []Extractor {
+	return []Extractor{ScriptSrcExtractor{}, PreloadExtractor{}}
+}
+
+// ScriptSrcExtractor finds <script src> URLs
+type ScriptSrcExtractor struct{}
+
+func (ScriptSrcExtractor) Extract(n *html.Node, base string) []string {
+	if n.Type != html.ElementNode || n.Data != "script" {
+		return nil
+	}
+	var out []string
+	for _, a := range n.Attr {
+		if a.Key == "src" {
+			out = append(out, resolveURL(base, a.Val))
 		}
-		status := resp.StatusCode
-		resp.Body.Close()
-		if status >= 400 {
-			fmt.Printf("[FLAG] %s returned %d\n", js, status)
-			fmt.Fprintln(bw, js)
-		} else {
-			fmt.Printf("[OK]   %s returned %d\n", js, status)
-			fmt.Fprintln(gw, js)
+	}
+	return out
+}
+
+// PreloadExtractor finds <link rel=modulepreload|prefetch as=script href> URLs
+type PreloadExtractor struct{}
+
+func (PreloadExtractor) Extract(n *html.Node, base string) []string {
+	if n.Type != html.ElementNode || n.Data != "link" {
+		return nil
+	}
+	var rel, as, href string
+	for _, a := range n.Attr {
+		switch a.Key {
+		case "rel":
+			rel = a.Val
+		case "as":
+			as = a.Val
+		case "href":
+			href = a.Val
 		}
 	}
-	gw.Flush()
-	bw.Flush()
+	if (rel == "modulepreload" || rel == "prefetch") && as == "script" {
+		return []string{resolveURL(base, href)}
+	}
+	return nil
+}
+
+// documentWriteCall matches a document.write/writeln call up to the end of its statement
+var documentWriteCall = regexp.MustCompile(`document\.write(?:ln)?\s*\(([^;\n]*)`)
+
+// writtenScriptSrc matches the src of a <script> tag in written markup
+var writtenScriptSrc = regexp.MustCompile(`(?i)<script\b[^>]*?\ssrc\s*=\s*["']?([^"'\s>]+)`)
+
+// stringJoin matches the seam where string literals are concatenated, as in '<scr' + 'ipt'
+var stringJoin = regexp.MustCompile(`["']\s*\+\s*["']`)
 
-	fmt.Printf("[DEBUG] Good JS in %s, bad JS in %s\n", goodFile, badFile)
-	fmt.Printf("[DEBUG] Pages visited: %d, JS files found: %d\n", len(seen), len(jsSet))
+// DocumentWriteExtractor finds <script src> URLs written by document.write calls in
+// inline scripts, which parsing alone never sees. It handles literals split with + and
+// escaped slashes, but not URLs built from variables.
+type DocumentWriteExtractor struct{}
+
+func (DocumentWriteExtractor) Extract(n *html.Node, base string) []string {
+	if n.Type != html.TextNode || n.Parent == nil || n.Parent.Data != "script" || !strings.Contains(n.Data, "document.write") {
+		return nil
+	}
+	var out []string
+	for _, call := range documentWriteCall.FindAllStringSubmatch(n.Data, -1) {
+		markup := stringJoin.ReplaceAllString(call[1], "")
+		markup = strings.NewReplacer(`\/`, "/", `\"`, `"`, `\'`, "'").Replace(markup)
+		for _, m := range writtenScriptSrc.FindAllStringSubmatch(markup, -1) {
+			out = append(out, resolveURL(base, m[1]))
+		}
+	}
+	return out
 }
 
-// extractJS finds <script src> and <link rel=modulepreload|prefetch as=script> URLs ending with .js
-func extractJS(htmlContent, base string) []string {
+// extractJS runs the extractors over every node of doc and keeps URLs whose path has a
+// JS extension. If ctx is cancelled mid-walk the URLs found so far are returned.
+func extractJS(ctx context.Context, doc *html.Node, base string, exts []string, extractors []Extractor) []string {
 	var out []string
-	doc, err := html.Parse(strings.NewReader(htmlContent))
-	if err != nil {
-		fmt.Printf("[ERROR] Parse HTML %s: %v\n", base, err)
-		return out
-	}
-	var rec func(*html.Node)
-	rec = func(n *html.Node) {
-		if n.Type == html.ElementNode {
-			if n.Data == "script" {
-				for _, a := range n.Attr {
-					if a.Key == "src" {
-						u := resolveURL(base, a.Val)
-						if strings.HasSuffix(u, ".js") {
-							out = append(out, u)
-						}
-					}
+	walk(ctx, doc, func(n *html.Node) {
+		for _, ex := range extractors {
+			for _, u := range ex.Extract(n, base) {
+				if hasJSExt(u, exts) {
+					out = append(out, u)
 				}
 			}
-			if n.Data == "link" {
-				var rel, as, href string
-				for _, a := range n.Attr {
-					switch a.Key {
-					case "rel":
-						rel = a.Val
-					case "as":
-						as = a.Val
-					case "href":
-						href = a.Val
-					}
-				}
-				if (rel == "modulepreload" || rel == "prefetch") && as == "script" {
-					u := resolveURL(base, href)
-					if strings.HasSuffix(u, ".js") {
+		}
+	})
+	return out
+}
+
+// linkHeaderJS returns the resolved targets of Link response header entries with
+// as=script, e.g. Link: </app.js>; rel=preload; as=script, as used by early hints and
+// server push. Each header value may hold several comma-separated links.
+func linkHeaderJS(h http.Header, base string, exts []string) []string {
+	var out []string
+	for _, v := range h.Values("Link") {
+		for v != "" {
+			start := strings.IndexByte(v, '<')
+			end := strings.IndexByte(v, '>')
+			if start < 0 || end < start {
+				break
+			}
+			target := v[start+1 : end]
+			params := v[end+1:]
+			// Params run until the comma that starts the next link
+			if next := strings.IndexByte(params, '<'); next >= 0 {
+				v = params[next:]
+				params = params[:next]
+			} else {
+				v = ""
+			}
+			for _, p := range strings.Split(params, ";") {
+				name, val, _ := strings.Cut(strings.TrimSpace(strings.TrimRight(strings.TrimSpace(p), ",")), "=")
+				if strings.EqualFold(strings.TrimSpace(name), "as") && strings.EqualFold(strings.Trim(strings.TrimSpace(val), `"`), "script") {
+					if u := resolveURL(base, target); hasJSExt(u, exts) {
 						out = append(out, u)
 					}
+					break
 				}
 			}
 		}
+	}
+	return out
+}
+
+// walkCheckEvery is how many nodes walk visits between checks for cancellation
+const walkCheckEvery = 1024
+
+// walk calls fn on each node of doc in document order. It checks ctx every
+// walkCheckEvery nodes and stops early once ctx is done, so callers get partial results.
+func walk(ctx context.Context, doc *html.Node, fn func(*html.Node)) {
+	visited := 0
+	var rec func(*html.Node) bool
+	rec = func(n *html.Node) bool {
+		if visited++; visited%walkCheckEvery == 0 && ctx.Err() != nil {
+			return false
+		}
+		fn(n)
 		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			rec(c)
+			if !rec(c) {
+				return false
+			}
 		}
+		return true
 	}
 	rec(doc)
-	return out
 }
 
-// extractLinks finds <a href> URLs
-func extractLinks(htmlContent, base string) []string {
-	var out []string
-	doc, err := html.Parse(strings.NewReader(htmlContent))
+// hasJSExt reports whether the path of u (ignoring query and fragment) ends with one of
+// exts, case-insensitively so /App.JS still counts; u itself is left as-is for fetching
+func hasJSExt(u string, exts []string) bool {
+	pu, err := url.Parse(u)
 	if err != nil {
-		return out
+		return false
 	}
-	var rec func(*html.Node)
-	rec = func(n *html.Node) {
-		if n.Type == html.ElementNode && n.Data == "a" {
-			for _, a := range n.Attr {
-				if a.Key == "href" {
-					u := resolveURL(base, a.Val)
-					out = append(out, u)
+	p := strings.ToLower(pu.Path)
+	for _, ext := range exts {
+		if strings.HasSuffix(p, strings.ToLower(ext)) {
+			return true
+		}
+	}
+	return false
+}
+
+// LinkRules controls which tags count as crawlable links. The zero value follows
+// every <a href>, including rel="nofollow" ones.
+type LinkRules struct {
+	SkipNofollow bool // skip <a rel="nofollow">
+	// OnSkip, if set, is told about each <a href> passed over and why
+	OnSkip          func(link, reason string)
+	FollowCanonical bool // also follow <link rel="canonical" href>
+	FollowAlternate bool // also follow <link rel="alternate" hreflang href> locale variants
+}
+
+// extractLinks finds <a href> URLs, plus any other links enabled by rules; like
+// extractJS it returns what it found so far if ctx is cancelled mid-walk
+func extractLinks(ctx context.Context, doc *html.Node, base string, rules LinkRules) []string {
+	var out []string
+	walk(ctx, doc, func(n *html.Node) {
+		if n.Type == html.ElementNode && (n.Data == "a" || n.Data == "link") {
+			rel, href := attr(n, "rel"), attr(n, "href")
+			switch {
+			case href == "":
+			case n.Data == "a" && rules.SkipNofollow && hasToken(rel, "nofollow"):
+				if rules.OnSkip != nil {
+					rules.OnSkip(resolveURL(base, href), "rel=nofollow under -skip-nofollow")
 				}
+			case n.Data == "a":
+				out = append(out, resolveURL(base, href))
+			case n.Data == "link" && rules.FollowCanonical && hasToken(rel, "canonical"):
+				out = append(out, resolveURL(base, href))
+			case n.Data == "link" && rules.FollowAlternate && hasToken(rel, "alternate") && attr(n, "hreflang") != "":
+				out = append(out, resolveURL(base, href))
 			}
 		}
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			rec(c)
+	})
+	return out
+}
+
+// stylesheets returns the resolved hrefs of the page's <link rel="stylesheet"> tags
+func stylesheets(ctx context.Context, doc *html.Node, base string) []string {
+	var out []string
+	walk(ctx, doc, func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "link" && hasToken(attr(n, "rel"), "stylesheet") {
+			if href := attr(n, "href"); href != "" {
+				out = append(out, resolveURL(base, href))
+			}
+		}
+	})
+	return out
+}
+
+// baseHref returns the href of the page's first <base href>, or ""
+func baseHref(ctx context.Context, doc *html.Node) string {
+	var href string
+	walk(ctx, doc, func(n *html.Node) {
+		if href == "" && n.Type == html.ElementNode && n.Data == "base" {
+			href = attr(n, "href")
+		}
+	})
+	return href
+}
+
+// canonicalHref returns the href of the page's <link rel="canonical">, or ""
+func canonicalHref(ctx context.Context, doc *html.Node) string {
+	var href string
+	walk(ctx, doc, func(n *html.Node) {
+		if href == "" && n.Type == html.ElementNode && n.Data == "link" && hasToken(attr(n, "rel"), "canonical") {
+			href = attr(n, "href")
+		}
+	})
+	return href
+}
+
+// metaRefresh returns the target of a <meta http-equiv="refresh" content="N;url=...">
+// tag, or "" if the page has none
+func metaRefresh(ctx context.Context, doc *html.Node) string {
+	var target string
+	walk(ctx, doc, func(n *html.Node) {
+		if target == "" && n.Type == html.ElementNode && n.Data == "meta" && strings.EqualFold(attr(n, "http-equiv"), "refresh") {
+			_, rest, ok := strings.Cut(attr(n, "content"), ";")
+			if ok {
+				rest = strings.TrimSpace(rest)
+				if len(rest) >= 4 && strings.EqualFold(rest[:4], "url=") {
+					rest = rest[4:]
+				}
+				target = strings.Trim(strings.TrimSpace(rest), `"'`)
+			}
+		}
+	})
+	return target
+}
+
+// postForm is a <form method=post> ready to submit
+type postForm struct {
+	action string
+	values url.Values
+	label  string // id, name and button labels, for matching -form-skip
+}
+
+// postForms returns the page's POST forms with the values a browser would submit
+// untouched: hidden inputs (CSRF tokens included) and other fields' defaults, checked
+// boxes, and each select's selected or first option. Buttons and file inputs are left out.
+func postForms(ctx context.Context, doc *html.Node, base string) []postForm {
+	var forms []postForm
+	walk(ctx, doc, func(n *html.Node) {
+		if n.Type != html.ElementNode || n.Data != "form" || !strings.EqualFold(attr(n, "method"), "post") {
+			return
+		}
+		action := base
+		if a := attr(n, "action"); a != "" {
+			action = resolveURL(base, a)
+		}
+		if action == "" {
+			return
+		}
+		f := postForm{action: action, values: url.Values{}, label: attr(n, "id") + " " + attr(n, "name")}
+		walk(ctx, n, func(n *html.Node) {
+			if n.Type != html.ElementNode {
+				return
+			}
+			name := attr(n, "name")
+			switch n.Data {
+			case "input":
+				switch typ := strings.ToLower(attr(n, "type")); typ {
+				case "submit", "button", "image", "reset":
+					f.label += " " + attr(n, "value")
+				case "file":
+				case "checkbox", "radio":
+					if name != "" && hasAttr(n, "checked") {
+						v := attr(n, "value")
+						if v == "" {
+							v = "on"
+						}
+						f.values.Add(name, v)
+					}
+				default:
+					if name != "" {
+						f.values.Add(name, attr(n, "value"))
+					}
+				}
+			case "textarea":
+				if name != "" {
+					text := ""
+					if n.FirstChild != nil && n.FirstChild.Type == html.TextNode {
+						text = n.FirstChild.Data
+					}
+					f.values.Add(name, text)
+				}
+			case "select":
+				if name != "" {
+					if v, ok := selectedOption(ctx, n); ok {
+						f.values.Add(name, v)
+					}
+				}
+			case "button":
+				if n.FirstChild != nil && n.FirstChild.Type == html.TextNode {
+					f.label += " " + n.FirstChild.Data
+				}
+			}
+		})
+		forms = append(forms, f)
+	})
+	return forms
+}
+
+// selectedOption returns the value of a <select>'s selected option, or of its first
+// option when none is selected
+func selectedOption(ctx context.Context, sel *html.Node) (string, bool) {
+	var first, chosen *html.Node
+	walk(ctx, sel, func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "option" {
+			if first == nil {
+				first = n
+			}
+			if chosen == nil && hasAttr(n, "selected") {
+				chosen = n
+			}
 		}
+	})
+	if chosen == nil {
+		chosen = first
 	}
-	rec(doc)
+	if chosen == nil {
+		return "", false
+	}
+	if hasAttr(chosen, "value") {
+		return attr(chosen, "value"), true
+	}
+	if chosen.FirstChild != nil && chosen.FirstChild.Type == html.TextNode {
+		return strings.TrimSpace(chosen.FirstChild.Data), true
+	}
+	return "", true
+}
+
+// scriptIntegrity maps each <script src> on the page to its integrity attribute
+func scriptIntegrity(ctx context.Context, doc *html.Node, base string) map[string]string {
+	out := map[string]string{}
+	walk(ctx, doc, func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "script" {
+			if src, sri := attr(n, "src"), strings.TrimSpace(attr(n, "integrity")); src != "" && sri != "" {
+				out[resolveURL(base, src)] = sri
+			}
+		}
+	})
 	return out
 }
 
-// resolveURL makes href absolute against base
+// sriMatches reports whether body matches the integrity metadata. As in browsers,
+// only the strongest of sha256/384/512 listed is checked and any of its hashes may match;
+// metadata with no supported algorithm is treated as matching.
+func sriMatches(integrity string, body []byte) bool {
+	digests := map[string]func([]byte) []byte{
+		"sha256": func(b []byte) []byte { s := sha256.Sum256(b); return s[:] },
+		"sha384": func(b []byte) []byte { s := sha512.Sum384(b); return s[:] },
+		"sha512": func(b []byte) []byte { s := sha512.Sum512(b); return s[:] },
+	}
+	byAlg := map[string][]string{}
+	for _, tok := range strings.Fields(integrity) {
+		alg, hash, ok := strings.Cut(tok, "-")
+		if !ok || digests[alg] == nil {
+			continue
+		}
+		hash, _, _ = strings.Cut(hash, "?") // drop options
+		byAlg[alg] = append(byAlg[alg], hash)
+	}
+	for _, alg := range []string{"sha512", "sha384", "sha256"} {
+		if hashes, ok := byAlg[alg]; ok {
+			got := base64.StdEncoding.EncodeToString(digests[alg](body))
+			for _, h := range hashes {
+				if h == got {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// streamParse tokenizes r into a flat document: a root node whose children are the
+// page's start tags with their attributes, and no nesting. The only text kept is each
+// inline <script>'s, as its child, for the extractors that read script bodies; other
+// extraction works on tags and attributes alone, so it finds the same URLs as a full
+// parse at a fraction of the memory. Form fields aren't tied to their forms.
+func streamParse(r io.Reader) (*html.Node, error) {
+	doc := &html.Node{Type: html.DocumentNode}
+	z := html.NewTokenizer(r)
+	var script *html.Node // open <script> awaiting its text
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if err := z.Err(); err != io.EOF {
+				return nil, err
+			}
+			return doc, nil
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			n := &html.Node{Type: html.ElementNode, DataAtom: tok.DataAtom, Data: tok.Data, Attr: tok.Attr}
+			doc.AppendChild(n)
+			script = nil
+			if tok.Type == html.StartTagToken && tok.Data == "script" {
+				script = n
+			}
+		case html.TextToken:
+			if script != nil {
+				script.AppendChild(&html.Node{Type: html.TextNode, Data: string(z.Text())})
+				script = nil
+			}
+		case html.EndTagToken:
+			script = nil
+		}
+	}
+}
+
+// metaRobots reports the noindex and nofollow directives of the page's
+// <meta name="robots"> tags; "none" means both
+func metaRobots(ctx context.Context, doc *html.Node) (noindex, nofollow bool) {
+	walk(ctx, doc, func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "meta" && strings.EqualFold(attr(n, "name"), "robots") {
+			for _, d := range strings.Split(attr(n, "content"), ",") {
+				switch strings.ToLower(strings.TrimSpace(d)) {
+				case "noindex":
+					noindex = true
+				case "nofollow":
+					nofollow = true
+				case "none":
+					noindex, nofollow = true, true
+				}
+			}
+		}
+	})
+	return noindex, nofollow
+}
+
+// attr returns the value of n's attribute key, or "" if absent
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// hasAttr reports whether n has the attribute key, even with an empty value
+func hasAttr(n *html.Node, key string) bool {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// hasToken reports whether the space-separated list (e.g. a rel attribute) contains tok
+func hasToken(list, tok string) bool {
+	for _, f := range strings.Fields(list) {
+		if strings.EqualFold(f, tok) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveURL makes href absolute against base. Results without a scheme (e.g. from a
+// scheme-less base) are rejected with "" since they can't be fetched.
 func resolveURL(base, href string) string {
 	u, err := url.Parse(href)
 	if err != nil {
@@ -226,12 +4598,226 @@ func resolveURL(base, href string) string {
 	if err != nil {
 		return ""
 	}
-	return bu.ResolveReference(u).String()
+	// Protocol-relative (//host/path): keep the referenced host, inherit the page scheme
+	if u.Scheme == "" && u.Host != "" {
+		if bu.Scheme == "" {
+			return ""
+		}
+		u.Scheme = bu.Scheme
+		return u.String()
+	}
+	resolved := bu.ResolveReference(u)
+	if resolved.Scheme == "" {
+		return ""
+	}
+	return resolved.String()
+}
+
+// normalizeURL puts u in a canonical form for dedup: the fragment is dropped, the
+// host lowercased, percent-encoding made uppercase with unreserved characters decoded,
+// and any -strip-params query parameters removed (keeping the rest in order)
+func (c *Crawler) normalizeURL(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil || u == "" {
+		return u
+	}
+	pu.Fragment, pu.RawFragment = "", ""
+	pu.Host = strings.ToLower(asciiHost(pu.Host))
+	if p := normalizePercent(pu.EscapedPath()); p != pu.EscapedPath() {
+		if unescaped, err := url.PathUnescape(p); err == nil {
+			pu.Path, pu.RawPath = unescaped, p
+		}
+	}
+	pu.RawQuery = normalizePercent(pu.RawQuery)
+	if len(c.StripParams) == 0 || pu.RawQuery == "" {
+		return pu.String()
+	}
+	var kept []string
+	for _, pair := range strings.Split(pu.RawQuery, "&") {
+		key, _, _ := strings.Cut(pair, "=")
+		if k, err := url.QueryUnescape(key); err == nil {
+			key = k
+		}
+		strip := false
+		for _, p := range c.StripParams {
+			if key == p {
+				strip = true
+				break
+			}
+		}
+		if !strip {
+			kept = append(kept, pair)
+		}
+	}
+	pu.RawQuery = strings.Join(kept, "&")
+	return pu.String()
+}
+
+// normalizePercent uppercases the hex of each %XX escape in s and decodes escapes of
+// unreserved characters (letters, digits, -._~), which mean the same either way.
+// Reserved escapes like %2F are kept since decoding them changes the URL.
+func normalizePercent(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			b.WriteByte(s[i])
+			continue
+		}
+		ch := byte(v)
+		if ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '-' || ch == '.' || ch == '_' || ch == '~' {
+			b.WriteByte(ch)
+		} else {
+			b.WriteString(strings.ToUpper(s[i : i+3]))
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+// jsLine formats a JS URL for the output files, with its referrer under -with-referrer
+func (c *Crawler) jsLine(js string) string {
+	if ref := c.jsSet[js]; c.WithReferrer && ref != "" {
+		return js + "\t" + ref
+	}
+	return js
+}
+
+// jsHostSummary lists each host serving JS with its file count, e.g. "cdn.example.com: 12, example.com: 30"
+func jsHostSummary(jsSet map[string]string) string {
+	counts := map[string]int{}
+	for js := range jsSet {
+		if u, err := url.Parse(js); err == nil {
+			counts[u.Host]++
+		}
+	}
+	hosts := make([]string, 0, len(counts))
+	for host := range counts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	parts := make([]string, len(hosts))
+	for i, host := range hosts {
+		parts[i] = fmt.Sprintf("%s: %d", host, counts[host])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// isWWWVariant reports whether a and b differ only by a leading "www."
+func isWWWVariant(a, b string) bool {
+	return !strings.EqualFold(a, b) &&
+		strings.EqualFold(strings.TrimPrefix(strings.ToLower(a), "www."), strings.TrimPrefix(strings.ToLower(b), "www."))
+}
+
+// wwwVariant returns host with "www." added or removed, or "" for IP literals
+func wwwVariant(host string) string {
+	h, _ := splitHostPort(host)
+	if net.ParseIP(h) != nil {
+		return ""
+	}
+	if len(host) > 4 && strings.EqualFold(host[:4], "www.") {
+		return host[4:]
+	}
+	return "www." + host
+}
+
+// writeGroupedByHost writes JS URLs under a "# host" header per host, sorted within each group
+func (c *Crawler) writeGroupedByHost(w io.Writer, jsSet map[string]string) {
+	groups := map[string][]string{}
+	for js := range jsSet {
+		host := ""
+		if u, err := url.Parse(js); err == nil {
+			host = u.Host
+		}
+		groups[host] = append(groups[host], js)
+	}
+	hosts := make([]string, 0, len(groups))
+	for host := range groups {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for i, host := range hosts {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "# %s\n", host)
+		urls := groups[host]
+		sort.Strings(urls)
+		for _, js := range urls {
+			fmt.Fprintln(w, c.jsLine(js))
+		}
+	}
 }
 
-// sameDomain ensures link host matches domain
+// sameDomain ensures link host matches domain; scheme-less links (e.g. an
+// unresolved protocol-relative //host/path) never match since they can't be fetched
 func sameDomain(link, domain string) bool {
 	u, err := url.Parse(link)
-	return err == nil && u.Host == domain
+	return err == nil && u.Scheme != "" && sameHost(u.Host, domain)
+}
+
+// sameHost compares host[:port] values; IP literals (including bracketed IPv6
+// like [::1]:8080) are compared by address so equivalent spellings match
+func sameHost(a, b string) bool {
+	ah, ap := splitHostPort(a)
+	bh, bp := splitHostPort(b)
+	if ap != bp {
+		return false
+	}
+	if aip, bip := net.ParseIP(ah), net.ParseIP(bh); aip != nil && bip != nil {
+		return aip.Equal(bip)
+	}
+	return strings.EqualFold(asciiHost(ah), asciiHost(bh))
+}
+
+// asciiHost converts the name in host[:port] to its punycode form, so münchen.de and
+// xn--mnchen-3ya.de compare equal. IP literals and names idna rejects are returned as is.
+func asciiHost(host string) string {
+	name, port := splitHostPort(host)
+	if net.ParseIP(name) != nil || isASCII(name) {
+		return host
+	}
+	ascii, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return host
+	}
+	if port != "" {
+		return net.JoinHostPort(ascii, port)
+	}
+	return ascii
+}
+
+// isASCII reports whether s has only ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// splitHostPort splits host[:port], tolerating a missing port and stripping IPv6 brackets
+func splitHostPort(hostport string) (host, port string) {
+	if h, p, err := net.SplitHostPort(hostport); err == nil {
+		return h, p
+	}
+	return strings.Trim(hostport, "[]"), ""
 }
-// jscrwal/jscrawl.go	
+
+// bracketIPv6 wraps a bare IPv6 literal (e.g. ::1) in brackets so it can be used in a URL
+func bracketIPv6(domain string) string {
+	if ip := net.ParseIP(domain); ip != nil && strings.Contains(domain, ":") {
+		return "[" + domain + "]"
+	}
+	return domain
+}
+
+// jscrwal/jscrawl.go
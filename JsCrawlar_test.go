@@ -0,0 +1,680 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// memSink is a ResultSink that keeps results in memory
+type memSink struct {
+	all, good, bad []string
+}
+
+func (s *memSink) WriteAll(url string)              { s.all = append(s.all, url) }
+func (s *memSink) WriteGood(url string, status int) { s.good = append(s.good, url) }
+func (s *memSink) WriteBad(url string, status int, err error) {
+	s.bad = append(s.bad, url)
+}
+func (s *memSink) Close() error { return nil }
+
+// serveSite serves pages by path on ln; paths ending in .js are served as JavaScript
+func serveSite(t *testing.T, ln net.Listener, pages map[string]string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, ".js") {
+			w.Header().Set("Content-Type", "application/javascript")
+		} else {
+			w.Header().Set("Content-Type", "text/html")
+		}
+		w.Write([]byte(body))
+	}))
+	if ln != nil {
+		srv.Listener.Close()
+		srv.Listener = ln
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// crawlSite runs c against srv over http with results kept in memory
+func crawlSite(t *testing.T, c *Crawler, srv *httptest.Server) *memSink {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	sink := &memSink{}
+	c.Domain, c.Scheme, c.Sink = strings.TrimPrefix(srv.URL, "http://"), "http", sink
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	slices.Sort(sink.all)
+	slices.Sort(sink.good)
+	return sink
+}
+
+func TestCrawlIPv6Loopback(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	srv := serveSite(t, ln, map[string]string{
+		"/":          `<a href="/page.html">page</a><script src="/a.js"></script>`,
+		"/page.html": `<script src="b.js"></script>`,
+		"/a.js":      `var a;`,
+		"/b.js":      `var b;`,
+	})
+	sink := crawlSite(t, &Crawler{}, srv)
+
+	want := []string{srv.URL + "/a.js", srv.URL + "/b.js"}
+	if !slices.Equal(sink.all, want) {
+		t.Errorf("found %v, want %v", sink.all, want)
+	}
+	if !slices.Equal(sink.good, want) {
+		t.Errorf("good %v, want %v", sink.good, want)
+	}
+}
+
+func TestResolveProtocolRelative(t *testing.T) {
+	tests := []struct {
+		base, href, want string
+		onCDN            bool // result is on cdn.example.com
+	}{
+		{"http://example.com/page", "//cdn.example.com/x.js", "http://cdn.example.com/x.js", true},
+		{"https://example.com/dir/page", "//cdn.example.com/x.js", "https://cdn.example.com/x.js", true},
+		{"https://example.com/", "//cdn.example.com:8443/x.js", "https://cdn.example.com:8443/x.js", false},
+		{"example.com/page", "//cdn.example.com/x.js", "", false},
+	}
+	for _, tt := range tests {
+		got := resolveURL(tt.base, tt.href)
+		if got != tt.want {
+			t.Errorf("resolveURL(%q, %q) = %q, want %q", tt.base, tt.href, got, tt.want)
+		}
+		if on := sameDomain(got, "cdn.example.com"); on != tt.onCDN {
+			t.Errorf("sameDomain(%q, cdn.example.com) = %v, want %v", got, on, tt.onCDN)
+		}
+		if sameDomain(got, "example.com") {
+			t.Errorf("sameDomain(%q, example.com) = true, want false", got)
+		}
+	}
+	// Unresolved, the scheme-less form never matches
+	if sameDomain("//cdn.example.com/x.js", "cdn.example.com") {
+		t.Error("sameDomain matched an unresolved protocol-relative URL")
+	}
+}
+
+func TestHasJSExtUppercase(t *testing.T) {
+	tests := []struct {
+		u    string
+		want bool
+	}{
+		{"https://example.com/App.JS", true},
+		{"https://example.com/x.MJS?v=1", true},
+		{"https://example.com/bundle.Js#top", true},
+		{"https://example.com/App.JSON", false},
+		{"https://example.com/page?f=x.JS", false},
+	}
+	for _, tt := range tests {
+		if got := hasJSExt(tt.u, defaultJSExts); got != tt.want {
+			t.Errorf("hasJSExt(%q) = %v, want %v", tt.u, got, tt.want)
+		}
+	}
+
+	// The URL keeps its case for fetching
+	doc, err := html.Parse(strings.NewReader(`<script src="/App.JS"></script><script src="/x.MJS?v=1"></script>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := extractJS(context.Background(), doc, "https://example.com/", defaultJSExts, DefaultExtractors())
+	slices.Sort(got)
+	want := []string{"https://example.com/App.JS", "https://example.com/x.MJS?v=1"}
+	if !slices.Equal(got, want) {
+		t.Errorf("extractJS = %v, want %v", got, want)
+	}
+}
+
+func TestSplitDomainArg(t *testing.T) {
+	tests := []struct {
+		arg, host, scheme string
+	}{
+		{"example.com", "example.com", ""},
+		{"example.com/", "example.com", ""},
+		{"https://example.com/", "example.com", "https"},
+		{"HTTP://example.com:8080/path", "example.com:8080", "http"},
+	}
+	for _, tt := range tests {
+		host, scheme := splitDomainArg(tt.arg)
+		if host != tt.host || scheme != tt.scheme {
+			t.Errorf("splitDomainArg(%q) = %q, %q, want %q, %q", tt.arg, host, scheme, tt.host, tt.scheme)
+		}
+	}
+}
+
+func TestResolveSchemelessBase(t *testing.T) {
+	tests := []struct {
+		base, href, want string
+	}{
+		{"https://example.com/", "/app.js", "https://example.com/app.js"},
+		{"https://example.com/dir/", "app.js", "https://example.com/dir/app.js"},
+		// A bare domain as base can't yield a fetchable URL
+		{"example.com", "/app.js", ""},
+		{"example.com/dir/", "app.js", ""},
+		// Absolute hrefs don't need the base's scheme
+		{"example.com", "http://example.com/app.js", "http://example.com/app.js"},
+	}
+	for _, tt := range tests {
+		if got := resolveURL(tt.base, tt.href); got != tt.want {
+			t.Errorf("resolveURL(%q, %q) = %q, want %q", tt.base, tt.href, got, tt.want)
+		}
+	}
+}
+
+// A bare domain gets the scheme given alongside it
+func TestCrawlBareDomain(t *testing.T) {
+	srv := serveSite(t, nil, map[string]string{
+		"/":       `<script src="app.js"></script>`,
+		"/app.js": `var a;`,
+	})
+	sink := crawlSite(t, &Crawler{}, srv)
+	if want := []string{srv.URL + "/app.js"}; !slices.Equal(sink.good, want) {
+		t.Errorf("good %v, want %v", sink.good, want)
+	}
+}
+
+func TestIDNHosts(t *testing.T) {
+	if got := asciiHost("münchen.de"); got != "xn--mnchen-3ya.de" {
+		t.Errorf("asciiHost(münchen.de) = %q", got)
+	}
+	if got := asciiHost("münchen.de:8080"); got != "xn--mnchen-3ya.de:8080" {
+		t.Errorf("asciiHost(münchen.de:8080) = %q", got)
+	}
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"münchen.de", "xn--mnchen-3ya.de", true},
+		{"MÜNCHEN.de", "xn--mnchen-3ya.de", true},
+		{"münchen.de:8080", "xn--mnchen-3ya.de:8080", true},
+		{"münchen.de:8080", "xn--mnchen-3ya.de", false},
+		{"munchen.de", "xn--mnchen-3ya.de", false},
+	}
+	for _, tt := range tests {
+		if got := sameHost(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameHost(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+	if !sameDomain("https://xn--mnchen-3ya.de/app.js", "münchen.de") {
+		t.Error("sameDomain didn't match the punycode link to the Unicode domain")
+	}
+}
+
+func TestNoCrawlIgnoresMetaRefresh(t *testing.T) {
+	srv := serveSite(t, nil, map[string]string{
+		"/":          `<meta http-equiv="refresh" content="0; url=/next.html"><script src="/a.js"></script>`,
+		"/next.html": `<script src="/b.js"></script>`,
+		"/a.js":      `var a;`,
+		"/b.js":      `var b;`,
+	})
+	sink := crawlSite(t, &Crawler{NoCrawl: true}, srv)
+	if want := []string{srv.URL + "/a.js"}; !slices.Equal(sink.all, want) {
+		t.Errorf("found %v, want %v", sink.all, want)
+	}
+}
+
+// A rate-limited POST is retried with its body intact
+func TestRetryAfter429KeepsBody(t *testing.T) {
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Write([]byte(`<form method="post" action="/search"><input name="q" value="x"></form>`))
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if len(bodies) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`<script src="/post.js"></script>`))
+	}))
+	t.Cleanup(srv.Close)
+	sink := crawlSite(t, &Crawler{CrawlForms: true}, srv)
+	if want := []string{"q=x", "q=x"}; !slices.Equal(bodies, want) {
+		t.Errorf("POST bodies %q, want %q", bodies, want)
+	}
+	if want := []string{srv.URL + "/post.js"}; !slices.Equal(sink.all, want) {
+		t.Errorf("found %v, want %v", sink.all, want)
+	}
+}
+
+func TestStrictJSBadStatus(t *testing.T) {
+	srv := serveSite(t, nil, map[string]string{
+		"/":      `<script src="/moved.js"></script><script src="/gone.js"></script><script src="/ok.js"></script>`,
+		"/ok.js": `var a;`,
+	})
+	mux := srv.Config.Handler
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved.js" {
+			http.Redirect(w, r, "/ok.js", http.StatusFound)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+	t.Chdir(t.TempDir())
+	c := &Crawler{StrictJS: true}
+	c.Domain, c.Scheme = strings.TrimPrefix(srv.URL, "http://"), "http"
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	data, err := os.ReadFile(c.Domain + "_bad_js.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSpace(string(data)), "\n")
+	slices.Sort(got)
+	want := []string{srv.URL + "/gone.js\t404", srv.URL + "/moved.js\t302"}
+	if !slices.Equal(got, want) {
+		t.Errorf("bad file %q, want %q", got, want)
+	}
+}
+
+// documentWritePage loads its real bundle through document.write, as old tag managers do
+const documentWritePage = `<html><head><script src="/static.js"></script>
+<script>
+  var v = 3;
+  document.write('<scr' + 'ipt src="\/dw.js"><\/scr' + 'ipt>');
+  document.writeln("<script type='text/javascript' src='/lib/ln.js?v=2'></script>");
+</script></head><body><p>hi</p></body></html>`
+
+func TestDocumentWriteExtractor(t *testing.T) {
+	want := []string{"https://example.com/dw.js", "https://example.com/lib/ln.js?v=2", "https://example.com/static.js"}
+	for name, parse := range map[string]func(io.Reader) (*html.Node, error){"dom": html.Parse, "stream": streamParse} {
+		doc, err := parse(strings.NewReader(documentWritePage))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		extractors := append(DefaultExtractors(), DocumentWriteExtractor{})
+		got := extractJS(context.Background(), doc, "https://example.com/", defaultJSExts, extractors)
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("%s parse: extractJS = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestJSONBlockURLs(t *testing.T) {
+	page := `<script id="__NEXT_DATA__" type="application/json">{"page":"/blog","buildId":"x","assets":["/j.js","https://cdn.example.com/k.mjs"],"n":1}</script>
+<script type="application/ld+json">{"url":"/about"}</script>
+<script type="application/json">not json</script>`
+	want := []string{"https://cdn.example.com/k.mjs", "https://example.com/about", "https://example.com/blog", "https://example.com/j.js"}
+	for name, parse := range map[string]func(io.Reader) (*html.Node, error){"dom": html.Parse, "stream": streamParse} {
+		doc, err := parse(strings.NewReader(page))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := jsonBlockURLs(context.Background(), doc, "https://example.com/"); !slices.Equal(got, want) {
+			t.Errorf("%s parse: jsonBlockURLs = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestRunRejectsSnapshotsWithBloom(t *testing.T) {
+	t.Chdir(t.TempDir())
+	c := &Crawler{Domain: "example.invalid", Scheme: "http", Bloom: true, SnapshotInterval: time.Second, Sink: &memSink{}}
+	if err := c.Run(context.Background()); err == nil {
+		t.Fatal("Run accepted SnapshotInterval with Bloom")
+	}
+}
+
+func TestPostForms(t *testing.T) {
+	page := `<form method="get" action="/search"><input name="q"></form>
+<form method="POST" action="/filter" id="f">
+  <input type="hidden" name="csrf" value="tok">
+  <input name="q" value="x"><input type="checkbox" name="c" checked><input type="checkbox" name="d" value="1">
+  <select name="s"><option value="a">A<option value="b" selected>B</select>
+  <select name="t"><option>First<option>Second</select>
+  <textarea name="note">hi</textarea><input type="file" name="up"><button>Go</button>
+</form>`
+	doc, err := html.Parse(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forms := postForms(context.Background(), doc, "https://example.com/page")
+	if len(forms) != 1 {
+		t.Fatalf("got %d forms, want 1", len(forms))
+	}
+	f := forms[0]
+	if f.action != "https://example.com/filter" {
+		t.Errorf("action %q", f.action)
+	}
+	if got, want := f.values.Encode(), "c=on&csrf=tok&note=hi&q=x&s=b&t=First"; got != want {
+		t.Errorf("values %q, want %q", got, want)
+	}
+	if !strings.Contains(f.label, "Go") || !strings.Contains(f.label, "f") {
+		t.Errorf("label %q lacks the id and button", f.label)
+	}
+}
+
+// Stream parsing loses which fields belong to a form, so forms aren't sent half-empty
+func TestCrawlFormsSkippedUnderStreamParse(t *testing.T) {
+	posts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			posts++
+		}
+		w.Write([]byte(`<form method="post" action="/search"><input type="hidden" name="csrf" value="tok"></form>`))
+	}))
+	t.Cleanup(srv.Close)
+	crawlSite(t, &Crawler{CrawlForms: true, StreamParse: true}, srv)
+	if posts != 0 {
+		t.Errorf("%d forms submitted under StreamParse", posts)
+	}
+}
+
+// Concurrent runs keep their own totals
+func TestSummaryPerCrawler(t *testing.T) {
+	clean := serveSite(t, nil, map[string]string{
+		"/":     `<script src="/a.js"></script><script src="/gone.js"></script>`,
+		"/a.js": `var a;`,
+	})
+	failing := serveSite(t, nil, map[string]string{
+		"/": `<script src="http://127.0.0.1:1/x.js"></script>`,
+	})
+	t.Chdir(t.TempDir())
+	run := func(c *Crawler, srv *httptest.Server, done chan<- Summary) {
+		c.Domain, c.Scheme, c.Sink = strings.TrimPrefix(srv.URL, "http://"), "http", &memSink{}
+		if err := c.Run(context.Background()); err != nil {
+			t.Errorf("Run: %v", err)
+		}
+		done <- c.Summary()
+	}
+	cleanDone, failingDone := make(chan Summary), make(chan Summary)
+	go run(&Crawler{}, clean, cleanDone)
+	go run(&Crawler{}, failing, failingDone)
+	cs, fs := <-cleanDone, <-failingDone
+
+	if cs.Errors != 0 || cs.PagesVisited != 1 || cs.JSFound != 2 || cs.Good != 1 || cs.Bad != 1 {
+		t.Errorf("clean summary %+v", cs)
+	}
+	if want := map[int]int{200: 1, 404: 1}; !maps.Equal(cs.StatusCounts, want) {
+		t.Errorf("clean status counts %v, want %v", cs.StatusCounts, want)
+	}
+	if fs.Errors != 1 || fs.Bad != 1 || fs.StatusCounts[0] != 1 {
+		t.Errorf("failing summary %+v", fs)
+	}
+}
+
+// fakeBrowser stands in for headless Chrome: it dumps a DOM with a runtime-inserted
+// script tag and writes an unterminated net log in which the page also loaded a chunk
+const fakeBrowser = `#!/bin/sh
+for a; do
+	case "$a" in
+	--log-net-log=*) log="${a#--log-net-log=}" ;;
+	*) page="$a" ;;
+	esac
+done
+printf '{"constants":{},"events":[\n{"params":{"method":"GET","url":"%s"},"type":2},\n{"params":{"url":"%schunks\\/42.js"},"type":2},\n{"params":{"url":"data:text/javascript,1"},"type":2},' "$page" "$page" >"$log"
+echo '<html><head><script src="/rendered.js"></script></head><body></body></html>'
+`
+
+func TestHeadlessCollectsRequestedJS(t *testing.T) {
+	bin := t.TempDir() + "/fake-chrome"
+	if err := os.WriteFile(bin, []byte(fakeBrowser), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	srv := serveSite(t, nil, map[string]string{
+		"/":             `<html><body><div id="app"></div></body></html>`,
+		"/rendered.js":  `var a;`,
+		"/chunks/42.js": `var b;`,
+	})
+	sink := crawlSite(t, &Crawler{Headless: true, HeadlessBin: bin}, srv)
+	want := []string{srv.URL + "/chunks/42.js", srv.URL + "/rendered.js"}
+	if !slices.Equal(sink.all, want) {
+		t.Errorf("found %v, want %v", sink.all, want)
+	}
+}
+
+func TestNetLogURLs(t *testing.T) {
+	data := []byte(`{"events":[{"params":{"url":"https://a.example/x.js?v=1"}},{"params":{"url": "https:\/\/a.example\/x.js?v=1"}},{"params":{"url":"chrome://newtab/"}},{"params":{"url":"https://b.exa`)
+	want := []string{"https://a.example/x.js?v=1"}
+	if got := netLogURLs(data); !slices.Equal(got, want) {
+		t.Errorf("netLogURLs = %v, want %v", got, want)
+	}
+}
+
+// A line reaches the file within about a second even if nothing else is written
+func TestLineWriterFlushesWhenQuiet(t *testing.T) {
+	name := t.TempDir() + "/out.txt"
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lw := newLineWriter(bufio.NewWriter(f))
+	defer lw.Close()
+	lw.WriteLine("first")
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if data, _ := os.ReadFile(name); string(data) == "first\n" {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Error("line still buffered after 3s")
+}
+
+// The retry after a 429 feeds the adaptive throttle like any other response
+func TestRetryAfter429Observed(t *testing.T) {
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits++; hits == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`<p>no scripts</p>`))
+	}))
+	t.Cleanup(srv.Close)
+	c := &Crawler{AdaptiveDelay: true, MaxDelay: time.Second}
+	crawlSite(t, c, srv)
+	if hits != 2 {
+		t.Fatalf("%d requests, want 2", hits)
+	}
+	if d := c.throttle.delay; d != 0 {
+		t.Errorf("delay %s after a successful retry, want 0", d)
+	}
+}
+
+// Concurrent runs each log their own errors to their own -error-log
+func TestErrorLogPerCrawler(t *testing.T) {
+	t.Chdir(t.TempDir())
+	var crawlers []*Crawler
+	done := make(chan struct{})
+	for _, name := range []string{"first", "second"} {
+		srv := serveSite(t, nil, map[string]string{
+			"/": `<script src="http://127.0.0.1:1/` + name + `.js"></script>`,
+		})
+		c := &Crawler{ErrorLog: true, Sink: &memSink{}}
+		c.Domain, c.Scheme = strings.TrimPrefix(srv.URL, "http://"), "http"
+		crawlers = append(crawlers, c)
+		go func() {
+			defer func() { done <- struct{}{} }()
+			if err := c.Run(context.Background()); err != nil {
+				t.Errorf("Run: %v", err)
+			}
+		}()
+	}
+	<-done
+	<-done
+	for i, name := range []string{"first", "second"} {
+		data, err := os.ReadFile(crawlers[i].Domain + "_errors.log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != 1 || !strings.Contains(lines[0], "/"+name+".js") {
+			t.Errorf("%s error log: %q", name, lines)
+		}
+	}
+}
+
+// Page-level lookups stop walking a huge page once the crawl is cancelled
+func TestPageLookupsStopWhenCancelled(t *testing.T) {
+	page := strings.Repeat("<p>x</p>", 5000) +
+		`<meta name="robots" content="noindex"><link rel="canonical" href="/c"><link rel="stylesheet" href="/s.css">` +
+		`<meta http-equiv="refresh" content="0; url=/next"><script src="/a.js" integrity="sha256-x"></script>`
+	doc, err := html.Parse(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "https://example.com/"
+	live := context.Background()
+	cancelled, cancel := context.WithCancel(live)
+	cancel()
+
+	if noindex, _ := metaRobots(live, doc); !noindex {
+		t.Error("metaRobots missed noindex")
+	}
+	if canonicalHref(live, doc) == "" || metaRefresh(live, doc) == "" || len(stylesheets(live, doc, base)) != 1 || len(scriptIntegrity(live, doc, base)) != 1 {
+		t.Error("a lookup missed its tag on an uncancelled walk")
+	}
+	if noindex, _ := metaRobots(cancelled, doc); noindex {
+		t.Error("metaRobots walked the whole page after cancellation")
+	}
+	if canonicalHref(cancelled, doc) != "" || metaRefresh(cancelled, doc) != "" || len(stylesheets(cancelled, doc, base)) != 0 || len(scriptIntegrity(cancelled, doc, base)) != 0 {
+		t.Error("a lookup walked the whole page after cancellation")
+	}
+}
+
+// Concurrent runs each report the invalid certificates they met
+func TestCertProblemsPerCrawler(t *testing.T) {
+	t.Chdir(t.TempDir())
+	var crawlers []*Crawler
+	done := make(chan struct{})
+	for range 2 {
+		srv := httptest.NewTLSServer(http.NotFoundHandler())
+		t.Cleanup(srv.Close)
+		c := &Crawler{Sink: &memSink{}}
+		c.Domain, c.Scheme = strings.TrimPrefix(srv.URL, "https://"), "https"
+		crawlers = append(crawlers, c)
+		go func() {
+			defer func() { done <- struct{}{} }()
+			c.Run(context.Background())
+		}()
+	}
+	<-done
+	<-done
+	for _, c := range crawlers {
+		data, err := os.ReadFile(c.Domain + "_tls_errors.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, _ := splitHostPort(c.Domain)
+		if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 || !strings.HasPrefix(lines[0], host+"\t") {
+			t.Errorf("%s TLS report: %q", c.Domain, lines)
+		}
+	}
+}
+
+// JS the appended good file already lists is still hashed under -baseline
+func TestAppendBaselineRetestsPriorJS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := serveSite(t, ln, map[string]string{
+		"/":     `<script src="/a.js"></script>`,
+		"/a.js": `var a;`,
+	})
+	domain := strings.TrimPrefix(srv.URL, "http://")
+	manifest := domain + "_js_manifest.txt"
+	crawlSite(t, &Crawler{Baseline: manifest}, srv)
+	js := srv.URL + "/a.js"
+	if err := os.WriteFile(domain+"_good_js.txt", []byte(js+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Crawler{Baseline: manifest, Append: true, Sink: &memSink{}}
+	c.Domain, c.Scheme = domain, "http"
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	hashes, err := readManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := hashes[js]; !ok {
+		t.Errorf("manifest lost %s: %v", js, hashes)
+	}
+	if s := c.Summary(); s.Good != 1 {
+		t.Errorf("Good = %d, want 1", s.Good)
+	}
+}
+
+// A soft-404 under -validate-js is suspect, counted as neither good nor bad
+func TestSuspectJSNotGoodOrBad(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := serveSite(t, ln, map[string]string{
+		"/":     `<script src="/a.js"></script>`,
+		"/a.js": `<!DOCTYPE html><html><body>Not found</body></html>`,
+	})
+	c := &Crawler{ValidateJS: true, CollapseHash: regexp.MustCompile(`\.[0-9a-f]{8}`)}
+	sink := crawlSite(t, c, srv)
+	if len(sink.good) != 0 || len(sink.bad) != 0 {
+		t.Errorf("good = %q, bad = %q", sink.good, sink.bad)
+	}
+	if s := c.Summary(); s.Good != 0 || s.Bad != 0 || s.Suspect != 1 {
+		t.Errorf("Summary good/bad/suspect = %d/%d/%d, want 0/0/1", s.Good, s.Bad, s.Suspect)
+	}
+	data, err := os.ReadFile(c.Domain + "_collapsed_js.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := srv.URL + "/a.js\turls=1\tgood=0\tbad=0\n"; string(data) != want {
+		t.Errorf("collapsed = %q, want %q", data, want)
+	}
+}
+
+// A Run rejected up front doesn't report the previous run's totals
+func TestRejectedRunResetsSummary(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := serveSite(t, ln, map[string]string{
+		"/":     `<script src="/a.js"></script>`,
+		"/a.js": `var a;`,
+	})
+	c := &Crawler{}
+	crawlSite(t, c, srv)
+	if s := c.Summary(); s.PagesVisited != 1 || s.Good != 1 {
+		t.Fatalf("first Summary = %+v", s)
+	}
+	c.Bloom, c.SnapshotInterval = true, time.Second
+	if err := c.Run(context.Background()); err == nil {
+		t.Fatal("Run accepted SnapshotInterval with Bloom")
+	}
+	if s := c.Summary(); s.PagesVisited != 0 || s.JSFound != 0 || s.Good != 0 || len(s.StatusCounts) != 0 {
+		t.Errorf("Summary after rejected Run = %+v", s)
+	}
+}
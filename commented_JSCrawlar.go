@@ -1,3 +1,7 @@
+//go:build ignore
+
+// The annotated copy of the original crawler, kept for reading; it is not part of the build.
+
 // jsCrawler.go
 // A sequential (one-page-at-a-time) web crawler that:
 // - Accepts a domain (and optional scheme) from the command line